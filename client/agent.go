@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jbltx/master-server/valve"
+)
+
+const (
+	// DefaultHeartbeatInterval is the delay between two heartbeats when Agent.Interval is zero
+	DefaultHeartbeatInterval = 60 * time.Second
+	// agentRetryInterval is the delay before a failed registration is tried again
+	agentRetryInterval = 5 * time.Second
+	// agentQuitTimeout bounds the quit request sent when the agent stops
+	agentQuitTimeout = 2 * time.Second
+)
+
+// Agent keeps a game server registered on a master server. Every heartbeat starts with
+// a join request, so the game server is registered again when the master server restarts
+// or forgets it, and the quit request is sent when the agent stops. The requests are sent
+// from the single local port of the Client, so the master server sees the same sender until
+// the quit. The Client is closed when the agent stops.
+type Agent struct {
+	// Client sends the requests. Its LocalAddr is the game port, or the heartbeats carry
+	// the game port in their GamePort when the agent runs next to the game server.
+	Client *Client
+	// Heartbeat holds the values sent in the heartbeats
+	Heartbeat valve.ChallengeRequest
+	// Query, if set, is sent an A2S_INFO query before each heartbeat to update its values
+	Query *valve.A2SClient
+	// Interval is the delay between two heartbeats
+	Interval time.Duration
+}
+
+// NewAgent creates an agent sending the heartbeat with the client
+func NewAgent(client *Client, heartbeat valve.ChallengeRequest) *Agent {
+	return &Agent{
+		Client:    client,
+		Heartbeat: heartbeat,
+		Interval:  DefaultHeartbeatInterval,
+	}
+}
+
+// Run sends the heartbeats until the context is canceled, then deregisters the game server.
+// The failed heartbeats are logged and tried again, only the quit request error is returned.
+func (a *Agent) Run(ctx context.Context) error {
+	interval := a.Interval
+	if interval == 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	retryInterval := agentRetryInterval
+	if interval < retryInterval {
+		retryInterval = interval
+	}
+
+	defer a.Client.Close()
+
+	registered := false
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if !registered {
+				return nil
+			}
+			// the quit request is sent from the port of the heartbeats
+			quitCtx, cancel := context.WithTimeout(context.Background(), agentQuitTimeout)
+			defer cancel()
+			return a.Client.Deregister(quitCtx)
+		case <-timer.C:
+		}
+
+		if err := a.beat(ctx); err != nil {
+			if ctx.Err() == nil {
+				log.Println("[WARN] The heartbeat has failed: " + err.Error())
+			}
+			timer.Reset(retryInterval)
+			continue
+		}
+		if !registered {
+			log.Println("[INFO] The game server has been registered on " + a.Client.Address)
+		}
+		registered = true
+		timer.Reset(interval)
+	}
+}
+
+// beat updates the heartbeat values from the game server if needed and registers it
+func (a *Agent) beat(ctx context.Context) error {
+	if a.Query != nil {
+		info, err := a.Query.Info(ctx)
+		if err != nil {
+			return err
+		}
+		a.applyInfo(info)
+	}
+	heartbeat := a.Heartbeat
+	return a.Client.Register(ctx, &heartbeat)
+}
+
+// applyInfo copies the A2S_INFO values which are also in the heartbeats
+func (a *Agent) applyInfo(info *valve.ServerInfo) {
+	a.Heartbeat.GameDir = info.Folder
+	a.Heartbeat.Map = info.Map
+	a.Heartbeat.Players = int32(info.Players)
+	a.Heartbeat.Max = int32(info.MaxPlayers)
+	a.Heartbeat.Bots = int32(info.Bots)
+	a.Heartbeat.Type = string(info.ServerType)
+	a.Heartbeat.OS = info.Environment.Normalize()
+	a.Heartbeat.Password = info.Password
+	a.Heartbeat.Secure = info.VAC
+	a.Heartbeat.Version = info.Version
+	if info.Port != 0 {
+		a.Heartbeat.GamePort = info.Port
+	}
+}
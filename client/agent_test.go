@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jbltx/master-server/valve"
+)
+
+// fakeMaster answers the join requests and reports the received packets
+type fakeMaster struct {
+	connection *net.UDPConn
+	packets    chan fakePacket
+}
+
+type fakePacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+func newFakeMaster(t *testing.T) *fakeMaster {
+	t.Helper()
+	connection, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeMaster{connection: connection, packets: make(chan fakePacket, 64)}
+	go m.serve()
+	t.Cleanup(func() { connection.Close() })
+	return m
+}
+
+func (m *fakeMaster) serve() {
+	buffer := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := m.connection.ReadFromUDP(buffer)
+		if err != nil {
+			close(m.packets)
+			return
+		}
+		data := append([]byte{}, buffer[:n]...)
+		if data[0] == valve.RequestJoinHeader {
+			m.connection.WriteToUDP(valve.MarshallJoinReply(1234), addr)
+		}
+		m.packets <- fakePacket{data: data, from: addr}
+	}
+}
+
+func (m *fakeMaster) next(t *testing.T) fakePacket {
+	t.Helper()
+	select {
+	case p := <-m.packets:
+		return p
+	case <-time.After(2 * time.Second):
+		t.Fatal("The fake master server hasn't received the expected packet")
+	}
+	return fakePacket{}
+}
+
+func TestAgentSendsFromOnePort(t *testing.T) {
+	m := newFakeMaster(t)
+	c := NewClient(m.connection.LocalAddr().String())
+	agent := NewAgent(c, valve.ChallengeRequest{
+		Protocol: 7,
+		GameDir:  "tf",
+		Map:      "ctf_2fort",
+		OS:       valve.OperatingSystem(valve.Linux),
+		Type:     string(valve.Dedicated),
+		Region:   valve.AllRegions,
+		Version:  "1",
+		GamePort: 27015,
+	})
+	agent.Interval = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- agent.Run(ctx) }()
+
+	var port int
+	for i := 0; i < 4; i++ {
+		join := m.next(t)
+		if join.data[0] != valve.RequestJoinHeader {
+			t.Fatalf("packet %d = %q, want a join request", i, join.data)
+		}
+		heartbeat := m.next(t)
+		var req valve.ChallengeRequest
+		if heartbeat.data[0] != valve.RequestChallengeHeader || valve.UnmarshallHeartbeat(heartbeat.data[1:], &req) != nil {
+			t.Fatalf("packet %d = %q, want a heartbeat", i, heartbeat.data)
+		}
+		if req.ChallengeValue != 1234 || req.GamePort != 27015 || req.Dialect != valve.SourceDialect {
+			t.Errorf("heartbeat %d = %+v, want the challenge 1234 and the game port 27015", i, req)
+		}
+		if i == 0 {
+			port = join.from.Port
+		}
+		if join.from.Port != port || heartbeat.from.Port != port {
+			t.Errorf("heartbeat %d sent from the ports %d and %d, want %d", i, join.from.Port, heartbeat.from.Port, port)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	for {
+		p := m.next(t)
+		if p.data[0] != valve.RequestQuitHeader {
+			continue
+		}
+		if p.from.Port != port {
+			t.Errorf("quit sent from the port %d, want %d", p.from.Port, port)
+		}
+		return
+	}
+}
@@ -1,28 +1,41 @@
 package client
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
-	"fmt"
-	"log"
+	"errors"
 	"net"
-	"os"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
+
+	"github.com/jbltx/master-server/valve"
+)
+
+const (
+	// DefaultTimeout is the delay to get a reply when Client.Timeout is zero
+	DefaultTimeout = 3 * time.Second
+	// maxPacketSize is the biggest datagram a master server sends
+	maxPacketSize = 1600
 )
 
+// ErrMalformedReply is returned when a master server reply can't be decoded
+var ErrMalformedReply = errors.New("The master server reply is malformed")
+
 type ServerEndpoint struct {
 	IP   net.IP
 	Port uint16
 }
 
-var nullEndpoint ServerEndpoint = ServerEndpoint{
-	IP:   net.ParseIP("0.0.0.0"),
-	Port: 0,
-}
-
+// NewServerEndpoint decodes a server list entry, 6 bytes for an IPv4 endpoint or 18 bytes for an IPv6 one
 func NewServerEndpoint(buffer []byte) *ServerEndpoint {
+	if len(buffer) == valve.ServerListIPv6EntrySize {
+		return &ServerEndpoint{
+			IP:   net.IP(append([]byte{}, buffer[:net.IPv6len]...)),
+			Port: binary.BigEndian.Uint16(buffer[net.IPv6len:]),
+		}
+	}
 	return &ServerEndpoint{
 		IP:   net.IPv4(buffer[0], buffer[1], buffer[2], buffer[3]),
 		Port: binary.BigEndian.Uint16(buffer[4:]),
@@ -30,127 +43,247 @@ func NewServerEndpoint(buffer []byte) *ServerEndpoint {
 }
 
 func (c *ServerEndpoint) String() string {
-	p := strconv.Itoa(int(c.Port))
-	return c.IP.String() + ":" + p
+	return net.JoinHostPort(c.IP.String(), strconv.Itoa(int(c.Port)))
 }
 
-func sendListRequest(c *net.UDPConn) {
-	const queryHeader byte = 0x31
-	var regionCode byte = 0xFF
-	ipStart := "0.0.0.0:0"
-	filter := ""
+// IsNull checks if the endpoint is the null one terminating the last page of a server list
+func (c *ServerEndpoint) IsNull() bool {
+	return c.Port == 0 && c.IP.IsUnspecified()
+}
 
-	var b bytes.Buffer
+// Client sends the Master Server Query Protocol requests to a master server
+type Client struct {
+	// Address is the host:port of the master server
+	Address string
+	// LocalAddr is the address the requests are sent from. The master server registers
+	// the sender endpoint, so Register, Heartbeat and Deregister must be sent from the
+	// game port, unless the heartbeats carry it in their GamePort (Source dialect).
+	// Any local port is used when it's empty, it's then kept until Close.
+	LocalAddr string
+	// Timeout is the delay to get a reply before the request is sent again
+	Timeout time.Duration
+	// Retries is the number of times a request without reply is sent again
+	Retries int
+	// IPv6 asks for the IPv6 entries in the server lists, so the IPv6 servers are listed too
+	IPv6 bool
 
-	b.WriteByte(queryHeader)
-	b.WriteByte(regionCode)
-	b.WriteString(ipStart)
-	b.WriteString(filter)
+	// connection sends Register, Heartbeat and Deregister, opened by the first of them
+	mu         sync.Mutex
+	connection net.Conn
+}
 
-	_, err := c.Write(b.Bytes())
-	if err != nil {
-		log.Fatal(err)
+// NewClient creates a client for the master server at the given host:port
+func NewClient(address string) *Client {
+	return &Client{
+		Address: address,
+		Timeout: DefaultTimeout,
+		Retries: 2,
+	}
+}
+
+// ListServers returns the servers of the region matching the filter, requesting every page
+// of the list. The filter is built with a valve.FilterBuilder or parsed with valve.ParseFilter,
+// a nil one matches all the servers. The handshake challenges of the master servers limiting
+// the large replies are answered.
+func (c *Client) ListServers(ctx context.Context, region valve.Region, filter valve.Filter) ([]ServerEndpoint, error) {
+	if c.IPv6 {
+		filter = append(filter[:len(filter):len(filter)], valve.FilterCondition{Key: valve.FilterIPv6, Value: "1"})
+	}
+	request := &valve.ServerListRequest{
+		Region: region,
+		Seed:   valve.NullSeed,
+		Filter: filter,
 	}
 
-	buffer := make([]byte, 1600)
-	n, _, err := c.ReadFromUDP(buffer)
+	connection, err := c.dial(ctx)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer connection.Close()
 
-	const structSize int = 6
+	servers := []ServerEndpoint{}
+	handshakes := 0
+	for {
+		packet, err := valve.MarshallServerListRequest(request)
+		if err != nil {
+			return nil, err
+		}
+		reply, err := c.exchange(ctx, connection, packet, valve.SimplePacketHeader)
+		if err != nil {
+			return nil, err
+		}
 
-	if n%structSize > 0 {
-		log.Fatal("Query list response has a length which is not multiple of 6")
-	}
+		// the replies are told apart by the bytes following the simple packet header,
+		// a master server limiting the large replies sends a handshake challenge first
+		headerSize := len(valve.SimplePacketHeader)
+		if bytes.HasPrefix(reply, valve.ChallengeHeader[headerSize:]) {
+			challenge, err := valve.UnmarshallJoinReply(reply[len(valve.ChallengeHeader)-headerSize:])
+			// a new challenge is sent when the previous one expires,
+			// more in a row means the master server doesn't accept them
+			handshakes++
+			if err != nil || handshakes > 2 {
+				return nil, ErrMalformedReply
+			}
+			request.Challenge = &challenge
+			continue
+		}
+		if !bytes.HasPrefix(reply, valve.ServerListHeader[headerSize:]) {
+			return nil, ErrMalformedReply
+		}
+		handshakes = 0
 
-	var replyHeader []byte = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x66, 0x0A}
-	if bytes.Equal(replyHeader, buffer[0:structSize]) {
-		res := buffer[structSize:n]
-		count := len(res)
-		i := 0
-		for count > 0 {
-			endpoint := NewServerEndpoint(res[i*structSize : i*structSize+structSize])
-			fmt.Println("- Server " + endpoint.String())
-			count -= 6
-			i++
+		var page valve.ServerListReply
+		if err = valve.UnmarshallServerListReply(reply[len(valve.ServerListHeader)-headerSize:], c.IPv6, &page); err != nil {
+			return nil, ErrMalformedReply
+		}
+		for _, server := range page.Servers {
+			servers = append(servers, ServerEndpoint{IP: server.IP, Port: server.Port})
+		}
+		if page.Last {
+			return servers, nil
 		}
-	} else {
-		log.Fatal("Query list response header is malformed")
+		if len(page.Servers) == 0 {
+			// neither a server nor the terminator, the next request would be the same
+			return nil, ErrMalformedReply
+		}
+		request.Seed = page.Servers[len(page.Servers)-1].String()
 	}
 }
 
-func sendJoinRequest(c *net.UDPConn) {
-	_, err := c.Write([]byte{0x71})
+// Register sends a join request and answers the received challenge with a heartbeat.
+// The ChallengeValue of the heartbeat is set by Register.
+func (c *Client) Register(ctx context.Context, heartbeat *valve.ChallengeRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	connection, err := c.gameConnection(ctx)
+	if err != nil {
+		return err
+	}
+	reply, err := c.exchange(ctx, connection, valve.MarshallJoinRequest(), valve.ChallengeHeader)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	heartbeat.ChallengeValue, err = valve.UnmarshallJoinReply(reply)
+	if err != nil {
+		return ErrMalformedReply
+	}
+	packet, err := valve.MarshallChallenge(heartbeat)
+	if err != nil {
+		return err
+	}
+	_, err = connection.Write(packet)
+	return err
+}
 
-	buffer := make([]byte, 1600)
-	n, _, err := c.ReadFromUDP(buffer)
+// Heartbeat sends a heartbeat answering a challenge received from a join request of
+// the same Client, the master server doesn't reply to it
+func (c *Client) Heartbeat(ctx context.Context, heartbeat *valve.ChallengeRequest) error {
+	packet, err := valve.MarshallChallenge(heartbeat)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return c.send(ctx, packet)
+}
 
-	var replyHeader []byte = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x73, 0x0A}
-	if bytes.Equal(replyHeader, buffer[0:6]) {
-		res := buffer[6:n]
-		if len(res) != 4 {
-			log.Fatal("Join response has invalid length to parse int32 value")
-		}
-		challengeNumber := int32(binary.BigEndian.Uint32(res))
-		challengeNumberStr := strconv.Itoa(int(challengeNumber))
-		fmt.Println("-> Received challenge number " + challengeNumberStr)
+// Deregister removes the game server from the master server list,
+// the master server doesn't reply to it
+func (c *Client) Deregister(ctx context.Context) error {
+	return c.send(ctx, valve.MarshallQuitRequest())
+}
+
+// Close closes the connection of Register, Heartbeat and Deregister, the next of
+// them opens a new one from another port when LocalAddr is empty
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connection == nil {
+		return nil
+	}
+	err := c.connection.Close()
+	c.connection = nil
+	return err
+}
 
-		challengeData := "0\n\\protocol\\7\\challenge\\" + challengeNumberStr
-		challengeData += "\\players\\1\\max\\4\\bots\\0\\gamedir\\cstrike"
-		challengeData += "\\map\\de_dust\\password\\0\\os\\l\\lan\\0\\region\\255"
-		challengeData += "\\type\\d\\secure\\0\\version\\1.0.0.28\\product\\cstrike\n"
-		_, err := c.Write([]byte(challengeData))
+// gameConnection returns the connection of the game server requests, it's called with mu held
+func (c *Client) gameConnection(ctx context.Context) (net.Conn, error) {
+	if c.connection == nil {
+		connection, err := c.dial(ctx)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
-
-	} else {
-		log.Fatal("Join response header is malformed")
+		c.connection = connection
 	}
+	return c.connection, nil
 }
 
-func runClient() {
-	arguments := os.Args
-	if len(arguments) == 1 {
-		fmt.Println("Please provide a host:port string")
-		return
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{}
+	if len(c.LocalAddr) > 0 {
+		localAddr, err := net.ResolveUDPAddr("udp", c.LocalAddr)
+		if err != nil {
+			return nil, err
+		}
+		dialer.LocalAddr = localAddr
 	}
-	CONNECT := arguments[1]
+	return dialer.DialContext(ctx, "udp", c.Address)
+}
 
-	s, err := net.ResolveUDPAddr("udp4", CONNECT)
-	c, err := net.DialUDP("udp4", nil, s)
+// send sends a request without reply from the port of the join requests
+func (c *Client) send(ctx context.Context, request []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	connection, err := c.gameConnection(ctx)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
+	deadline, _ := ctx.Deadline()
+	connection.SetWriteDeadline(deadline)
+	_, err = connection.Write(request)
+	return err
+}
 
-	fmt.Printf("The UDP server is %s\n", c.RemoteAddr().String())
-	defer c.Close()
-
+// exchange sends the request until a reply starting with the header arrives,
+// and returns the reply without its header
+func (c *Client) exchange(ctx context.Context, connection net.Conn, request []byte, header []byte) ([]byte, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	buffer := make([]byte, maxPacketSize)
+	// a connection kept between the requests may hold the late reply of a previous request
+	connection.SetReadDeadline(time.Now())
 	for {
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Print(">> ")
-		text, _ := reader.ReadString('\n')
-		data := []byte(text + "\n")
-		cmd := strings.TrimSpace(string(data))
-
-		switch cmd {
-		case "STOP":
-			fmt.Println("Exiting UDP client!")
-			return
-		case "LIST":
-			sendListRequest(c)
-		case "JOIN":
-			sendJoinRequest(c)
-		default:
-			continue
+		if _, err := connection.Read(buffer); err != nil {
+			break
+		}
+	}
+
+	var err error
+	for attempt := 0; attempt <= c.Retries; attempt++ {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(timeout)
+		if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		connection.SetDeadline(deadline)
+
+		if _, err = connection.Write(request); err != nil {
+			return nil, err
+		}
+		var n int
+		n, err = connection.Read(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+		if !bytes.HasPrefix(buffer[:n], header) {
+			return nil, ErrMalformedReply
 		}
+		return append([]byte{}, buffer[len(header):n]...), nil
 	}
+	return nil, err
 }
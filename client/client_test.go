@@ -0,0 +1,248 @@
+package client
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jbltx/master-server/valve"
+)
+
+// listMaster answers the server list requests with pages of its servers,
+// the challenge, when set, is asked for before the first page
+type listMaster struct {
+	servers   []valve.ServerAddress
+	pageSize  int
+	challenge func(request *valve.ServerListRequest) (int32, bool)
+
+	mu       sync.Mutex
+	requests []valve.ServerListRequest
+}
+
+func (m *listMaster) listen(t *testing.T) string {
+	t.Helper()
+	connection, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connection.Close() })
+	go func() {
+		buffer := make([]byte, maxPacketSize)
+		for {
+			n, addr, err := connection.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			var request valve.ServerListRequest
+			if n == 0 || buffer[0] != valve.RequestServerListHeader || valve.UnmarshallServerListRequest(buffer[1:n], &request) != nil {
+				continue
+			}
+			connection.WriteToUDP(m.reply(&request), addr)
+		}
+	}()
+	return connection.LocalAddr().String()
+}
+
+func (m *listMaster) reply(request *valve.ServerListRequest) []byte {
+	m.mu.Lock()
+	m.requests = append(m.requests, *request)
+	m.mu.Unlock()
+	if m.challenge != nil {
+		if challenge, ask := m.challenge(request); ask {
+			return valve.MarshallJoinReply(challenge)
+		}
+	}
+
+	start := 0
+	if request.Seed != valve.NullSeed {
+		for start < len(m.servers) && m.servers[start].String() != request.Seed {
+			start++
+		}
+		start++
+	}
+	end := start + m.pageSize
+	if end > len(m.servers) {
+		end = len(m.servers)
+	}
+	ipv6 := false
+	for _, condition := range request.Filter {
+		ipv6 = ipv6 || (condition.Key == valve.FilterIPv6 && condition.Value == "1")
+	}
+	return valve.MarshallServerListReply(&valve.ServerListReply{
+		Servers: m.servers[start:end],
+		IPv6:    ipv6,
+		Last:    end == len(m.servers),
+	})
+}
+
+// seeds returns the seeds of the received requests
+func (m *listMaster) seeds() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seeds := []string{}
+	for _, request := range m.requests {
+		seeds = append(seeds, request.Seed)
+	}
+	return seeds
+}
+
+func testServerAddresses(t *testing.T, endpoints ...string) []valve.ServerAddress {
+	t.Helper()
+	addresses := []valve.ServerAddress{}
+	for _, endpoint := range endpoints {
+		addr, err := net.ResolveUDPAddr("udp", endpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addresses = append(addresses, valve.ServerAddress{IP: addr.IP, Port: uint16(addr.Port)})
+	}
+	return addresses
+}
+
+func endpointStrings(servers []ServerEndpoint) []string {
+	endpoints := []string{}
+	for i := range servers {
+		endpoints = append(endpoints, servers[i].String())
+	}
+	return endpoints
+}
+
+func newTestClient(address string) *Client {
+	c := NewClient(address)
+	c.Timeout = 500 * time.Millisecond
+	return c
+}
+
+func TestListServersPages(t *testing.T) {
+	endpoints := []string{"192.0.2.1:27015", "192.0.2.1:27016", "192.0.2.2:27015", "198.51.100.7:27015", "203.0.113.9:27020"}
+	m := &listMaster{servers: testServerAddresses(t, endpoints...), pageSize: 2}
+	c := newTestClient(m.listen(t))
+
+	servers, err := c.ListServers(context.Background(), valve.Europe, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := endpointStrings(servers); !reflect.DeepEqual(got, endpoints) {
+		t.Errorf("ListServers() = %v, want %v", got, endpoints)
+	}
+	// each page starts after the last server of the previous one
+	if got, want := m.seeds(), []string{valve.NullSeed, endpoints[1], endpoints[3]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("seeds = %v, want %v", got, want)
+	}
+}
+
+func TestListServersIPv6(t *testing.T) {
+	endpoints := []string{"192.0.2.1:27015", "[2001:db8::1]:27015", "[2001:db8::2]:27016"}
+	m := &listMaster{servers: testServerAddresses(t, endpoints...), pageSize: 2}
+	c := newTestClient(m.listen(t))
+	c.IPv6 = true
+
+	filter, err := valve.NewFilterBuilder().GameDir("cstrike").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := c.ListServers(context.Background(), valve.AllRegions, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := endpointStrings(servers); !reflect.DeepEqual(got, endpoints) {
+		t.Errorf("ListServers() = %v, want %v", got, endpoints)
+	}
+	if got, want := m.seeds(), []string{valve.NullSeed, endpoints[1]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("seeds = %v, want %v", got, want)
+	}
+	// the ipv6 key is added to a copy of the filter
+	if len(filter) != 1 {
+		t.Errorf("the filter has been modified: %v", filter)
+	}
+}
+
+func TestListServersHandshake(t *testing.T) {
+	endpoints := []string{"192.0.2.1:27015", "192.0.2.2:27015", "192.0.2.3:27015"}
+	// the first challenge expires after the first page, then a new one is asked for
+	challenge := int32(1000)
+	m := &listMaster{servers: testServerAddresses(t, endpoints...), pageSize: 1}
+	m.challenge = func(request *valve.ServerListRequest) (int32, bool) {
+		if request.Seed == endpoints[1] && challenge == 1000 {
+			challenge = 1001
+		}
+		return challenge, request.Challenge == nil || *request.Challenge != challenge
+	}
+	c := newTestClient(m.listen(t))
+
+	servers, err := c.ListServers(context.Background(), valve.AllRegions, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := endpointStrings(servers); !reflect.DeepEqual(got, endpoints) {
+		t.Errorf("ListServers() = %v, want %v", got, endpoints)
+	}
+	want := []string{valve.NullSeed, valve.NullSeed, endpoints[0], endpoints[1], endpoints[1]}
+	if got := m.seeds(); !reflect.DeepEqual(got, want) {
+		t.Errorf("seeds = %v, want %v", got, want)
+	}
+}
+
+func TestListServersHandshakeRejected(t *testing.T) {
+	// the master server never accepts the answered challenges
+	m := &listMaster{servers: testServerAddresses(t, "192.0.2.1:27015"), pageSize: 1}
+	m.challenge = func(request *valve.ServerListRequest) (int32, bool) { return 42, true }
+	c := newTestClient(m.listen(t))
+
+	if servers, err := c.ListServers(context.Background(), valve.AllRegions, nil); err != ErrMalformedReply {
+		t.Fatalf("ListServers() = %v, %v, want %v", servers, err, ErrMalformedReply)
+	}
+	if got := len(m.seeds()); got != 3 {
+		t.Errorf("the client sent %d requests, want 3", got)
+	}
+}
+
+func TestClientSendsFromOnePort(t *testing.T) {
+	m := newFakeMaster(t)
+	c := newTestClient(m.connection.LocalAddr().String())
+	defer c.Close()
+	ctx := context.Background()
+	heartbeat := valve.ChallengeRequest{Protocol: 48, GameDir: "cstrike", Map: "de_dust2", Region: valve.AllRegions, Version: "1"}
+
+	if err := c.Register(ctx, &heartbeat); err != nil {
+		t.Fatal(err)
+	}
+	if heartbeat.ChallengeValue != 1234 {
+		t.Errorf("ChallengeValue = %d, want the challenge of the join reply", heartbeat.ChallengeValue)
+	}
+	if err := c.Heartbeat(ctx, &heartbeat); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Deregister(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// join, heartbeat, heartbeat and quit, all from the port which received the challenge
+	headers := []byte{valve.RequestJoinHeader, valve.RequestChallengeHeader, valve.RequestChallengeHeader, valve.RequestQuitHeader}
+	var from *net.UDPAddr
+	for _, header := range headers {
+		packet := m.next(t)
+		if packet.data[0] != header {
+			t.Fatalf("packet %q, want the header %q", packet.data, header)
+		}
+		if from == nil {
+			from = packet.from
+		} else if packet.from.String() != from.String() {
+			t.Errorf("the %q packet has been sent from %s, want %s", header, packet.from, from)
+		}
+	}
+
+	// a closed client sends its next requests from a new port
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Deregister(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if packet := m.next(t); packet.from.String() == from.String() {
+		t.Errorf("the quit after Close has been sent from the previous port %s", packet.from)
+	}
+}
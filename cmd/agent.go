@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jbltx/master-server/client"
+	"github.com/jbltx/master-server/valve"
+)
+
+var agentOptions struct {
+	master    string
+	local     string
+	query     string
+	interval  time.Duration
+	heartbeat valve.ChallengeRequest
+	region    uint8
+	os        string
+}
+
+// AgentCmd runs a heartbeat agent next to a dedicated server
+var AgentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "Keep a game server registered on a master server",
+	Long: `Keep a game server registered on a master server.
+
+The master server registers the endpoint the heartbeats are sent from, unless they
+carry the game port: an agent running next to the game server gives its port with
+--gameport, since the game port is already bound by the game server. An agent sending
+the heartbeats in place of the game server can send them from the game port (--local).
+The heartbeat values are taken from the flags, or from the game server itself with an
+A2S_INFO query (--query).`,
+	Run: runAgentCmd,
+}
+
+func init() {
+	flags := AgentCmd.Flags()
+	flags.StringVar(&agentOptions.master, "master", "", "The host:port of the master server")
+	flags.StringVar(&agentOptions.local, "local", "", "The address the heartbeats are sent from, any local port when empty")
+	flags.Uint16Var(&agentOptions.heartbeat.GamePort, "gameport", 0, "The game port, sent in the heartbeats so the game server is listed on it")
+	flags.StringVar(&agentOptions.query, "query", "", "The host:port of the game server to query with A2S_INFO before each heartbeat")
+	flags.DurationVar(&agentOptions.interval, "interval", client.DefaultHeartbeatInterval, "The delay between two heartbeats")
+	flags.Int32Var(&agentOptions.heartbeat.Protocol, "protocol", 7, "The protocol version of the game server")
+	flags.Int32Var(&agentOptions.heartbeat.Max, "max", 0, "The maximum players count")
+	flags.StringVar(&agentOptions.heartbeat.GameDir, "gamedir", "", "The game directory, like cstrike")
+	flags.StringVar(&agentOptions.heartbeat.Map, "map", "", "The current map")
+	flags.StringVar(&agentOptions.heartbeat.Type, "type", string(valve.Dedicated), "The server type (d, l or p)")
+	flags.StringVar(&agentOptions.os, "os", string(valve.Linux), "The server platform (l, w or o)")
+	flags.Uint8Var(&agentOptions.region, "region", uint8(valve.AllRegions), "The region code of the game server")
+	flags.BoolVar(&agentOptions.heartbeat.Password, "password", false, "The game server is protected by a password")
+	flags.BoolVar(&agentOptions.heartbeat.Secure, "secure", false, "The game server uses an anti-cheat")
+	flags.StringVar(&agentOptions.heartbeat.Version, "version", "", "The version of the game server")
+	flags.StringVar(&agentOptions.heartbeat.Product, "product", "", "The product name, the game directory when empty")
+	AgentCmd.MarkFlagRequired("master")
+	RootCmd.AddCommand(AgentCmd)
+}
+
+func runAgentCmd(cmd *cobra.Command, args []string) {
+	heartbeat := agentOptions.heartbeat
+	heartbeat.Region = valve.Region(agentOptions.region)
+	heartbeat.OS = valve.OperatingSystem(agentOptions.os)
+	if len(heartbeat.Product) == 0 {
+		heartbeat.Product = heartbeat.GameDir
+	}
+
+	masterClient := client.NewClient(agentOptions.master)
+	masterClient.LocalAddr = agentOptions.local
+	agent := client.NewAgent(masterClient, heartbeat)
+	agent.Interval = agentOptions.interval
+	if len(agentOptions.query) > 0 {
+		agent.Query = valve.NewA2SClient(agentOptions.query)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %v, deregistering the game server", sig)
+		cancel()
+	}()
+
+	if err := agent.Run(ctx); err != nil {
+		log.Fatalf("Unable to deregister the game server: %v", err)
+	}
+}
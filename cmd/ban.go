@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jbltx/master-server/config"
+	"github.com/jbltx/master-server/server"
+)
+
+var banOptions struct {
+	reason   string
+	duration time.Duration
+}
+
+const bansHelp = `The target is an IP address, a CIDR network like 192.168.0.0/24, or an IP:port endpoint.
+
+The bans are saved in the database, a running master server loads them again
+periodically. The bolt database file is locked by a running master server,
+so it has to be stopped before changing its bans.`
+
+// BanCmd bans a network or an endpoint
+var BanCmd = &cobra.Command{
+	Use:   "ban <target>",
+	Short: "Ban an IP address, a network or an endpoint",
+	Long:  "Ban an IP address, a network or an endpoint.\n\n" + bansHelp,
+	Args:  cobra.ExactArgs(1),
+	Run:   runBanCmd,
+}
+
+// UnbanCmd removes the ban of a network or an endpoint
+var UnbanCmd = &cobra.Command{
+	Use:   "unban <target>",
+	Short: "Remove the ban of an IP address, a network or an endpoint",
+	Long:  "Remove the ban of an IP address, a network or an endpoint.\n\n" + bansHelp,
+	Args:  cobra.ExactArgs(1),
+	Run:   runUnbanCmd,
+}
+
+// BansCmd lists the active bans
+var BansCmd = &cobra.Command{
+	Use:   "bans",
+	Short: "List the active bans",
+	Args:  cobra.NoArgs,
+	Run:   runBansCmd,
+}
+
+func init() {
+	flags := BanCmd.Flags()
+	flags.StringVar(&banOptions.reason, "reason", "", "The reason of the ban")
+	flags.DurationVar(&banOptions.duration, "duration", 0, "The duration of the ban, like 24h, the ban is permanent when it's 0")
+	RootCmd.AddCommand(BanCmd, UnbanCmd, BansCmd)
+}
+
+// openBanStore opens the store holding the bans of the configured master server
+func openBanStore(ctx context.Context) server.Store {
+	if !mainCfg.IsValid() {
+		log.Fatal("No valid configuration found, run the master server once to set it up")
+	}
+	if mainCfg.Database.Driver == config.MemoryDriver {
+		log.Fatal("The bans can't be changed with the memory database driver")
+	}
+	store, err := server.NewStore(ctx, mainCfg)
+	if err != nil {
+		log.Fatalf("Unable to open the database: %v", err)
+	}
+	return store
+}
+
+func runBanCmd(cmd *cobra.Command, args []string) {
+	ban, err := server.NewBan(args[0], banOptions.reason, banOptions.duration)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	store := openBanStore(ctx)
+	defer store.Close(ctx)
+	if err = store.SaveBan(ctx, ban); err != nil {
+		log.Fatalf("Unable to save the ban: %v", err)
+	}
+	fmt.Println(ban.Target() + " has been banned")
+}
+
+func runUnbanCmd(cmd *cobra.Command, args []string) {
+	network, port, err := server.ParseBanTarget(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	store := openBanStore(ctx)
+	defer store.Close(ctx)
+	ban := &server.Ban{Network: network.String(), Port: int32(port)}
+	removed, err := store.RemoveBan(ctx, ban)
+	if err != nil {
+		log.Fatalf("Unable to remove the ban: %v", err)
+	}
+	if !removed {
+		fmt.Println(ban.Target() + " isn't banned")
+		return
+	}
+	fmt.Println(ban.Target() + " has been unbanned")
+}
+
+func runBansCmd(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+	store := openBanStore(ctx)
+	defer store.Close(ctx)
+	bans, err := store.FindBans(ctx, time.Now())
+	if err != nil {
+		log.Fatalf("Unable to list the bans: %v", err)
+	}
+	for _, ban := range bans {
+		expiration := "permanent"
+		if !ban.ExpiresAt.IsZero() {
+			expiration = "until " + ban.ExpiresAt.Format(time.RFC3339)
+		}
+		if ban.Automatic {
+			expiration += ", automatic"
+		}
+		fmt.Printf("%s\t%s\t%s\n", ban.Target(), expiration, ban.Reason)
+	}
+}
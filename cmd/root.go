@@ -2,14 +2,18 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/AlecAivazis/survey/v2/terminal"
 
@@ -32,6 +36,9 @@ var (
 	mainCfg      config.Config
 )
 
+// shutdownTimeout is the delay given to the server to handle the queued packets when it's stopped
+const shutdownTimeout = 10 * time.Second
+
 // RootCmd is the root command used to start the Master Server
 var RootCmd = &cobra.Command{
 	Short: "Master Server - v0.1.0",
@@ -152,26 +159,19 @@ func runInteractiveSetup(cfg *config.Config) error {
 			Validate: survey.MinLength(3),
 		},
 		{
-			Name: "database_url",
-			Prompt: &survey.Input{
-				Message: "Enter the URL of the MongoDB database",
-				Help:    "The URL should follows this template : 'mongodb+srv://<user>:<password>@<hostname>[:<port>]/<database>'",
-			},
-			Validate: survey.Required,
-		},
-		{
-			Name: "database_name",
-			Prompt: &survey.Input{
-				Message: "Enter the name of the MongoDB database",
+			Name: "database_driver",
+			Prompt: &survey.Select{
+				Message: "Choose where the game servers are stored",
+				Options: []string{config.MongoDriver, config.BoltDriver, config.MemoryDriver},
+				Default: config.MongoDriver,
+				Help:    "The bolt storage is a local file, the memory storage doesn't need any database but the game servers are lost when the application exits",
 			},
-			Validate: survey.Required,
 		},
 	}
 	answers := struct {
-		Port         uint16
-		Domain       string
-		DatabaseURL  string `survey:"database_url"`
-		DatabaseName string `survey:"database_name"`
+		Port           uint16
+		Domain         string
+		DatabaseDriver string `survey:"database_driver"`
 	}{}
 	err := survey.Ask(questions, &answers)
 	if err != nil {
@@ -184,8 +184,58 @@ func runInteractiveSetup(cfg *config.Config) error {
 
 	cfg.Port = answers.Port
 	cfg.Domain = answers.Domain
-	cfg.Database.URL = answers.DatabaseURL
-	cfg.Database.Name = answers.DatabaseName
+	cfg.Database.Driver = answers.DatabaseDriver
+
+	if answers.DatabaseDriver == config.MongoDriver {
+		databaseQuestions := []*survey.Question{
+			{
+				Name: "database_url",
+				Prompt: &survey.Input{
+					Message: "Enter the URL of the MongoDB database",
+					Help:    "The URL should follows this template : 'mongodb+srv://<user>:<password>@<hostname>[:<port>]/<database>'",
+				},
+				Validate: survey.Required,
+			},
+			{
+				Name: "database_name",
+				Prompt: &survey.Input{
+					Message: "Enter the name of the MongoDB database",
+				},
+				Validate: survey.Required,
+			},
+		}
+		databaseAnswers := struct {
+			DatabaseURL  string `survey:"database_url"`
+			DatabaseName string `survey:"database_name"`
+		}{}
+		err = survey.Ask(databaseQuestions, &databaseAnswers)
+		if err != nil {
+			if err != terminal.InterruptErr {
+				fmt.Println("Setup cancelled.")
+				return nil
+			}
+			return err
+		}
+		cfg.Database.URL = databaseAnswers.DatabaseURL
+		cfg.Database.Name = databaseAnswers.DatabaseName
+	}
+
+	if answers.DatabaseDriver == config.BoltDriver {
+		var databasePath string
+		prompt := &survey.Input{
+			Message: "Enter the path of the database file",
+			Default: "master-server.db",
+		}
+		err = survey.AskOne(prompt, &databasePath, survey.WithValidator(survey.Required))
+		if err != nil {
+			if err != terminal.InterruptErr {
+				fmt.Println("Setup cancelled.")
+				return nil
+			}
+			return err
+		}
+		cfg.Database.Path = databasePath
+	}
 
 	fmt.Println("End of interactive setup, please launch the application again.")
 
@@ -202,8 +252,31 @@ func runRootCmd(cmd *cobra.Command, args []string) {
 		loadConfigAndSave(&mainCfg, false)
 		return
 	}
-	masterServer = server.NewMasterServer(mainCfg)
-	if err := masterServer.Listen(); err != nil {
+	store, err := server.NewStore(context.Background(), mainCfg)
+	if err != nil {
+		log.Fatalf("Unable to open the database: %v", err)
+	}
+	masterServer, err = server.NewMasterServer(mainCfg, store)
+	if err != nil {
+		log.Fatalf("Unable to create the server: %v", err)
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		sig := <-signals
+		log.Printf("Received %v, shutting down the server", sig)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := masterServer.Shutdown(ctx); err != nil {
+			log.Printf("An error has occured during the shutdown: %v", err)
+		}
+	}()
+
+	if err := masterServer.Listen(context.Background()); err != nil {
 		log.Fatalf("An error has occured with the server: %v", err)
 	}
+	<-shutdownDone
 }
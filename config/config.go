@@ -3,13 +3,38 @@ package config
 const (
 	ServersCollectionName    string = "game-servers"
 	ChallengesCollectionName string = "challenges"
-	ServerListMaxCount       int64  = 25
+	BansCollectionName       string = "bans"
+	// DefaultMaxPacketSize is the datagram size used by the Valve master servers
+	DefaultMaxPacketSize uint16 = 1400
+	// MinMaxPacketSize fits a server list reply header, one server and the terminator,
+	// with the 18 bytes entries of the clients asking for the IPv6 servers
+	MinMaxPacketSize uint16 = 42
+)
+
+const (
+	// MongoDriver stores the game servers in a MongoDB database
+	MongoDriver string = "mongodb"
+	// MemoryDriver keeps the game servers in memory, they are lost when the process exits
+	MemoryDriver string = "memory"
+	// BoltDriver stores the game servers in a bbolt file, no external service is needed
+	BoltDriver string = "bolt"
+)
+
+const (
+	// StatelessChallenges derives the challenges from a rotating secret, nothing is stored
+	StatelessChallenges string = "stateless"
+	// DatabaseChallenges stores every issued challenge in the database
+	DatabaseChallenges string = "database"
 )
 
 // DatabaseConfig is the configuration data structure for the database
 type DatabaseConfig struct {
-	URL  string
-	Name string
+	// Driver selects the store implementation, MongoDriver when empty
+	Driver string
+	URL    string
+	Name   string
+	// Path is the database file used by BoltDriver
+	Path string
 }
 
 // DashboardConfig is the configuration data structure for the dashboard
@@ -17,14 +42,73 @@ type DashboardConfig struct {
 	Port uint16
 }
 
+// RateLimitConfig is the configuration data structure for the rate limits of a request type.
+// The rates are in packets per second and a rate of 0 disables the limit.
+type RateLimitConfig struct {
+	// Rate is the number of packets per second accepted from an IP address
+	Rate uint32
+	// Burst is the number of packets an IP address can send at once, 0 means Rate
+	Burst uint32
+	// SubnetRate is the number of packets per second accepted from all the addresses
+	// of a subnet, the subnets are sized by LimitsConfig
+	SubnetRate uint32
+	// SubnetBurst is the number of packets a subnet can send at once, 0 means SubnetRate
+	SubnetBurst uint32
+}
+
+// LimitsConfig is the configuration data structure for the limits protecting the master server
+// from the floods, and the hosts whose address is spoofed from the amplified replies
+type LimitsConfig struct {
+	List      RateLimitConfig
+	Join      RateLimitConfig
+	Quit      RateLimitConfig
+	Challenge RateLimitConfig
+	// SubnetIPv4Prefix is the prefix length of the rate limited IPv4 subnets, 0 means 24
+	SubnetIPv4Prefix uint8
+	// SubnetIPv6Prefix is the prefix length of the rate limited IPv6 subnets, 0 means 64
+	SubnetIPv6Prefix uint8
+	// ResponseBytes is the number of reply bytes per second sent to all the clients, 0 is unlimited
+	ResponseBytes uint32
+	// ResponseBurst is the number of reply bytes which can be sent at once, 0 means ResponseBytes
+	ResponseBurst uint32
+	// ListHandshakeSize is the size in bytes above which a server list reply is only sent to the
+	// clients answering a handshake challenge, 0 disables the handshake. The legacy clients
+	// don't answer it, so they only get the lists which are small enough.
+	ListHandshakeSize uint16
+}
+
 // Config is the main configuration data structure
 type Config struct {
 	Port                uint16
 	Domain              string
 	HeartbeatExpiration int32
 	ChallengeExpiration int32
-	Dashboard           DashboardConfig
-	Database            DatabaseConfig
+	// ChallengeMode is StatelessChallenges (the default when empty) or DatabaseChallenges
+	ChallengeMode string
+	// Workers is the number of goroutines handling the packets, 0 means one per CPU
+	Workers uint16
+	// QueueSize is the number of packets waiting for a worker before new ones are dropped, 0 means 1024
+	QueueSize uint32
+	// MaxPacketSize is the maximum size of a reply datagram, 0 means DefaultMaxPacketSize
+	MaxPacketSize uint16
+	// ServerListPageSize caps the servers count of a list reply, 0 fills the whole datagram
+	ServerListPageSize uint16
+	// VerifyServers only lists the game servers answering an A2S_INFO query on their address
+	VerifyServers bool
+	// ProbeInterval is the delay in seconds between two A2S_INFO probes of a game server
+	ProbeInterval uint32
+	// ProbeTimeout is the delay in seconds to wait for an A2S_INFO reply
+	ProbeTimeout uint16
+	// BanThreshold is the number of heartbeats answering a bad challenge before an endpoint
+	// is banned for BanDuration seconds, 0 disables the automatic bans
+	BanThreshold uint16
+	// BanWindow is the delay in seconds during which the challenge failures are counted
+	BanWindow uint32
+	// BanDuration is the duration in seconds of the automatic bans
+	BanDuration uint32
+	Limits      LimitsConfig
+	Dashboard   DashboardConfig
+	Database    DatabaseConfig
 }
 
 // IsValid checks if the configuration instance has all values defined with valid data
@@ -41,10 +125,38 @@ func (cfg *Config) IsValid() bool {
 	if cfg.ChallengeExpiration <= 0 {
 		return false
 	}
-	if len(cfg.Database.URL) == 0 {
+	switch cfg.ChallengeMode {
+	case StatelessChallenges, DatabaseChallenges, "":
+	default:
+		return false
+	}
+	if cfg.MaxPacketSize != 0 && cfg.MaxPacketSize < MinMaxPacketSize {
+		return false
+	}
+	if cfg.VerifyServers && (cfg.ProbeInterval == 0 || cfg.ProbeTimeout == 0) {
+		return false
+	}
+	if cfg.BanThreshold > 0 && (cfg.BanWindow == 0 || cfg.BanDuration == 0) {
+		return false
+	}
+	if cfg.Limits.SubnetIPv4Prefix > 32 || cfg.Limits.SubnetIPv6Prefix > 128 {
 		return false
 	}
-	if len(cfg.Database.Name) == 0 {
+	switch cfg.Database.Driver {
+	case MongoDriver, "":
+		if len(cfg.Database.URL) == 0 {
+			return false
+		}
+		if len(cfg.Database.Name) == 0 {
+			return false
+		}
+	case BoltDriver:
+		if len(cfg.Database.Path) == 0 {
+			return false
+		}
+	case MemoryDriver:
+		// nothing to connect to
+	default:
 		return false
 	}
 
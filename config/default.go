@@ -7,9 +7,33 @@ func NewDefaultConfig() Config {
 		Domain:              "localhost",
 		HeartbeatExpiration: 300,
 		ChallengeExpiration: 30,
+		ChallengeMode:       StatelessChallenges,
+		Workers:             0,
+		QueueSize:           0,
+		MaxPacketSize:       DefaultMaxPacketSize,
+		ServerListPageSize:  0,
+		VerifyServers:       true,
+		ProbeInterval:       60,
+		ProbeTimeout:        3,
+		BanThreshold:        5,
+		BanWindow:           60,
+		BanDuration:         600,
+		Limits: LimitsConfig{
+			List:              RateLimitConfig{Rate: 10, Burst: 30, SubnetRate: 50, SubnetBurst: 150},
+			Join:              RateLimitConfig{Rate: 2, Burst: 5, SubnetRate: 20, SubnetBurst: 50},
+			Quit:              RateLimitConfig{Rate: 2, Burst: 5, SubnetRate: 20, SubnetBurst: 50},
+			Challenge:         RateLimitConfig{Rate: 2, Burst: 5, SubnetRate: 20, SubnetBurst: 50},
+			SubnetIPv4Prefix:  24,
+			SubnetIPv6Prefix:  64,
+			ResponseBytes:     4000000,
+			ResponseBurst:     4000000,
+			ListHandshakeSize: 0,
+		},
 		Database: DatabaseConfig{
-			URL:  "",
-			Name: "",
+			Driver: MongoDriver,
+			URL:    "",
+			Name:   "",
+			Path:   "",
 		},
 		Dashboard: DashboardConfig{
 			Port: 3000,
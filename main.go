@@ -8,6 +8,6 @@ import (
 
 func main() {
 	if err := cmd.RootCmd.Execute(); err != nil {
-		log.Fatal("An error has occured during execution of the process: %v", err)
+		log.Fatalf("An error has occured during execution of the process: %v", err)
 	}
 }
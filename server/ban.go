@@ -0,0 +1,303 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Ban prevents an endpoint, or all the endpoints of a network, from using the master server.
+// The banned endpoints get no reply and their heartbeats are ignored.
+type Ban struct {
+	ID primitive.ObjectID `bson:"_id,omitempty"`
+	// Network is the banned network in the CIDR notation, a single address is a /32 or /128 network
+	Network string `bson:"network"`
+	// Port restricts the ban to one port, 0 bans all the ports
+	Port      int32     `bson:"port"`
+	Reason    string    `bson:"reason,omitempty"`
+	CreatedAt time.Time `bson:"createdAt"`
+	// ExpiresAt is zero for a permanent ban
+	ExpiresAt time.Time `bson:"expiresAt,omitempty"`
+	// Automatic is set on the bans issued after repeated challenge failures
+	Automatic bool `bson:"automatic,omitempty"`
+}
+
+// NewBan creates a ban of the target, which is an IP address, a CIDR network or an IP:port endpoint.
+// The ban is permanent when the duration is 0.
+func NewBan(target string, reason string, duration time.Duration) (*Ban, error) {
+	network, port, err := ParseBanTarget(target)
+	if err != nil {
+		return nil, err
+	}
+	ban := &Ban{
+		Network:   network.String(),
+		Port:      int32(port),
+		Reason:    reason,
+		CreatedAt: time.Now(),
+	}
+	if duration > 0 {
+		ban.ExpiresAt = ban.CreatedAt.Add(duration)
+	}
+	return ban, nil
+}
+
+// ParseBanTarget parses an IP address, a CIDR network or an IP:port endpoint,
+// the returned port is 0 unless the target is an endpoint
+func ParseBanTarget(target string) (*net.IPNet, uint16, error) {
+	if strings.Contains(target, "/") {
+		_, network, err := net.ParseCIDR(target)
+		if err != nil {
+			return nil, 0, errors.New("The ban target " + target + " is an invalid network")
+		}
+		return network, 0, nil
+	}
+	if ip := net.ParseIP(target); ip != nil {
+		return addressNetwork(ip), 0, nil
+	}
+	if len(target) == 0 {
+		return nil, 0, errors.New("The ban target is empty")
+	}
+	endpoint, err := ParseServerEndpoint(target)
+	if err != nil {
+		return nil, 0, err
+	}
+	return addressNetwork(endpoint.IP), endpoint.Port, nil
+}
+
+// addressNetwork returns the network containing only the address
+func addressNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+// Key identifies the ban in the stores, a ban replaces the previous one of the same network and port
+func (b *Ban) Key() string {
+	return b.Network + "#" + strconv.Itoa(int(b.Port))
+}
+
+// Target returns the banned network, or the banned endpoint when the ban has a port
+func (b *Ban) Target() string {
+	if b.Port == 0 {
+		return b.Network
+	}
+	ip, _, _ := net.ParseCIDR(b.Network)
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(b.Port)))
+}
+
+// IsActive checks if the ban hasn't expired at the given date
+func (b *Ban) IsActive(now time.Time) bool {
+	return b.ExpiresAt.IsZero() || b.ExpiresAt.After(now)
+}
+
+// bannedNetwork is a parsed ban of the banList
+type bannedNetwork struct {
+	key       string
+	network   *net.IPNet
+	port      uint16
+	expiresAt time.Time
+}
+
+// banList is the copy of the store bans checked for every received packet,
+// it's reloaded periodically so that the bans added by other processes are applied
+type banList struct {
+	mu   sync.RWMutex
+	bans []bannedNetwork
+}
+
+func newBannedNetwork(ban *Ban) (bannedNetwork, error) {
+	_, network, err := net.ParseCIDR(ban.Network)
+	if err != nil {
+		return bannedNetwork{}, err
+	}
+	return bannedNetwork{
+		key:       ban.Key(),
+		network:   network,
+		port:      uint16(ban.Port),
+		expiresAt: ban.ExpiresAt,
+	}, nil
+}
+
+// set replaces the list, the invalid bans are skipped
+func (l *banList) set(bans []Ban) {
+	parsed := make([]bannedNetwork, 0, len(bans))
+	for i := range bans {
+		b, err := newBannedNetwork(&bans[i])
+		if err != nil {
+			log.Println("[WARN] The ban of " + bans[i].Network + " is invalid: " + err.Error())
+			continue
+		}
+		parsed = append(parsed, b)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bans = parsed
+}
+
+func (l *banList) add(ban *Ban) error {
+	b, err := newBannedNetwork(ban)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.bans {
+		if l.bans[i].key == b.key {
+			l.bans[i] = b
+			return nil
+		}
+	}
+	l.bans = append(l.bans, b)
+	return nil
+}
+
+func (l *banList) remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.bans {
+		if l.bans[i].key == key {
+			l.bans = append(l.bans[:i], l.bans[i+1:]...)
+			return
+		}
+	}
+}
+
+func (l *banList) isBanned(endpoint *ServerEndpoint, now time.Time) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for i := range l.bans {
+		b := &l.bans[i]
+		if !b.expiresAt.IsZero() && !b.expiresAt.After(now) {
+			continue
+		}
+		if (b.port == 0 || b.port == endpoint.Port) && b.network.Contains(endpoint.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// challengeFailures counts the heartbeats answering an unknown or wrong challenge,
+// an endpoint is banned when it fails too many times during the window
+type challengeFailures struct {
+	threshold int
+	window    time.Duration
+
+	mu     sync.Mutex
+	counts map[EndpointKey]*failureCount
+}
+
+type failureCount struct {
+	count int
+	since time.Time
+}
+
+func newChallengeFailures(threshold int, window time.Duration) *challengeFailures {
+	return &challengeFailures{
+		threshold: threshold,
+		window:    window,
+		counts:    make(map[EndpointKey]*failureCount),
+	}
+}
+
+// record counts a failure of the endpoint and returns true when it has to be banned
+func (f *challengeFailures) record(endpoint *ServerEndpoint, now time.Time) bool {
+	key := endpoint.Key()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	failures, found := f.counts[key]
+	if !found || now.Sub(failures.since) > f.window {
+		failures = &failureCount{since: now}
+		f.counts[key] = failures
+	}
+	failures.count++
+	if failures.count < f.threshold {
+		return false
+	}
+	delete(f.counts, key)
+	return true
+}
+
+// purge forgets the failures older than the window
+func (f *challengeFailures) purge(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, failures := range f.counts {
+		if now.Sub(failures.since) > f.window {
+			delete(f.counts, key)
+		}
+	}
+}
+
+// Ban bans the target, which is an IP address, a CIDR network or an IP:port endpoint.
+// The ban is saved in the store and applied at once, it's permanent when the duration is 0.
+func (ms *MasterServer) Ban(ctx context.Context, target string, reason string, duration time.Duration) (*Ban, error) {
+	ban, err := NewBan(target, reason, duration)
+	if err != nil {
+		return nil, err
+	}
+	if err = ms.saveBan(ctx, ban); err != nil {
+		return nil, err
+	}
+	return ban, nil
+}
+
+func (ms *MasterServer) saveBan(ctx context.Context, ban *Ban) error {
+	if err := ms.store.SaveBan(ctx, ban); err != nil {
+		return err
+	}
+	return ms.bans.add(ban)
+}
+
+// Unban removes the ban of the target, given like for Ban
+func (ms *MasterServer) Unban(ctx context.Context, target string) (bool, error) {
+	network, port, err := ParseBanTarget(target)
+	if err != nil {
+		return false, err
+	}
+	ban := &Ban{Network: network.String(), Port: int32(port)}
+	removed, err := ms.store.RemoveBan(ctx, ban)
+	if err != nil {
+		return false, err
+	}
+	ms.bans.remove(ban.Key())
+	return removed, nil
+}
+
+// refreshBans reloads the bans from the store
+func (ms *MasterServer) refreshBans(ctx context.Context) error {
+	bans, err := ms.store.FindBans(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	ms.bans.set(bans)
+	return nil
+}
+
+// recordChallengeFailure counts a heartbeat answering a bad challenge
+// and bans the endpoint for a while when it fails too many times
+func (ms *MasterServer) recordChallengeFailure(ctx context.Context, endpoint *ServerEndpoint) {
+	if ms.challengeFailures == nil || !ms.challengeFailures.record(endpoint, time.Now()) {
+		return
+	}
+	// only the endpoint is banned, the source address of a heartbeat can be spoofed
+	duration := time.Duration(ms.cfg.BanDuration) * time.Second
+	ban, err := NewBan(endpoint.String(), "Too many challenge failures", duration)
+	if err == nil {
+		ban.Automatic = true
+		err = ms.saveBan(ctx, ban)
+	}
+	if err != nil {
+		log.Println("[WARN] Unable to ban the endpoint (" + endpoint.String() + "): " + err.Error())
+		return
+	}
+	log.Println("[WARN] CHALLENGE - The endpoint has been banned after too many challenge failures (" + endpoint.String() + ")")
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jbltx/master-server/valve"
+)
+
+func TestParseBanTarget(t *testing.T) {
+	tests := []struct {
+		target  string
+		network string
+		port    uint16
+	}{
+		{"192.0.2.1", "192.0.2.1/32", 0},
+		{"::ffff:192.0.2.1", "192.0.2.1/32", 0},
+		{"192.0.2.0/24", "192.0.2.0/24", 0},
+		// the host bits of a network are cleared
+		{"192.0.2.77/24", "192.0.2.0/24", 0},
+		{"192.0.2.1:27015", "192.0.2.1/32", 27015},
+		{"2001:db8::1", "2001:db8::1/128", 0},
+		{"2001:db8::/32", "2001:db8::/32", 0},
+		{"[2001:db8::1]:27015", "2001:db8::1/128", 27015},
+	}
+	for _, tt := range tests {
+		network, port, err := ParseBanTarget(tt.target)
+		if err != nil {
+			t.Errorf("ParseBanTarget(%q) error = %v", tt.target, err)
+			continue
+		}
+		if network.String() != tt.network || port != tt.port {
+			t.Errorf("ParseBanTarget(%q) = %s, %d, want %s, %d", tt.target, network, port, tt.network, tt.port)
+		}
+	}
+
+	for _, target := range []string{"", "192.0.2.0/33", "2001:db8::/129", "192.0.2/24", "not an address", "192.0.2.1:65536", "192.0.2.1:port", "2001:db8::1:27015"} {
+		if network, port, err := ParseBanTarget(target); err == nil {
+			t.Errorf("ParseBanTarget(%q) = %s, %d, want an error", target, network, port)
+		}
+	}
+}
+
+func TestBanListIsBanned(t *testing.T) {
+	now := time.Now()
+	var list banList
+	list.set([]Ban{
+		{Network: "198.51.100.0/24"},
+		{Network: "192.0.2.1/32", Port: 27015},
+		{Network: "2001:db8::/32", ExpiresAt: now.Add(time.Hour)},
+		{Network: "203.0.113.5/32", ExpiresAt: now.Add(-time.Second)},
+		// skipped
+		{Network: "invalid"},
+	})
+
+	tests := []struct {
+		endpoint string
+		at       time.Time
+		want     bool
+	}{
+		// the whole network on every port
+		{"198.51.100.1:27015", now, true},
+		{"198.51.100.254:1", now, true},
+		{"198.51.101.1:27015", now, false},
+		// a single port of the address
+		{"192.0.2.1:27015", now, true},
+		{"192.0.2.1:27016", now, false},
+		{"192.0.2.2:27015", now, false},
+		// until its expiration
+		{"[2001:db8:ffff::1]:27015", now, true},
+		{"[2001:db8:ffff::1]:27015", now.Add(time.Hour), false},
+		{"[2001:db9::1]:27015", now, false},
+		{"203.0.113.5:27015", now, false},
+	}
+	for _, tt := range tests {
+		if got := list.isBanned(testEndpoint(t, tt.endpoint), tt.at); got != tt.want {
+			t.Errorf("isBanned(%s, %s) = %v, want %v", tt.endpoint, tt.at.Sub(now), got, tt.want)
+		}
+	}
+
+	// a ban of the same network and port replaces the previous one
+	replaced, err := NewBan("192.0.2.1:27015", "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := list.add(replaced); err != nil {
+		t.Fatal(err)
+	}
+	if list.isBanned(testEndpoint(t, "192.0.2.1:27015"), now.Add(2*time.Minute)) {
+		t.Error("The replaced permanent ban is still applied")
+	}
+	list.remove((&Ban{Network: "198.51.100.0/24"}).Key())
+	if list.isBanned(testEndpoint(t, "198.51.100.1:27015"), now) {
+		t.Error("The removed ban is still applied")
+	}
+}
+
+func TestChallengeFailuresRecord(t *testing.T) {
+	failures := newChallengeFailures(3, time.Minute)
+	now := time.Now()
+	endpoint := testEndpoint(t, "192.0.2.1:27015")
+	other := testEndpoint(t, "192.0.2.1:27016")
+
+	for i := 1; i < 3; i++ {
+		if failures.record(endpoint, now) {
+			t.Fatalf("record() = true after %d failures", i)
+		}
+	}
+	// the failures of each endpoint are counted apart
+	if failures.record(other, now) {
+		t.Error("record(other endpoint) = true after its first failure")
+	}
+	if !failures.record(endpoint, now.Add(time.Second)) {
+		t.Fatal("record() = false at the threshold")
+	}
+	// the count starts again once the endpoint is banned
+	if failures.record(endpoint, now.Add(2*time.Second)) {
+		t.Error("record() = true after the ban")
+	}
+
+	// the failures older than the window are forgotten
+	failures.record(other, now)
+	if failures.record(other, now.Add(time.Minute+time.Second)) {
+		t.Error("record() = true with a failure out of the window")
+	}
+	failures.purge(now.Add(3 * time.Minute))
+	if len(failures.counts) != 0 {
+		t.Errorf("purge() kept %d counts", len(failures.counts))
+	}
+}
+
+func TestChallengeFailuresBan(t *testing.T) {
+	ms := newTestMasterServer(t)
+	ctx := context.Background()
+	endpoint := testEndpoint(t, "192.0.2.1:27015")
+	join := valve.MarshallJoinRequest()
+
+	response, err := ms.handlePacket(ctx, join, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := valve.UnmarshallJoinReply(response[len(valve.ChallengeHeader):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := []byte(fmt.Sprintf(goldSrcTestHeartbeat, challenge^1))
+	for i := 1; i <= int(ms.cfg.BanThreshold); i++ {
+		if ms.bans.isBanned(endpoint, time.Now()) {
+			t.Fatalf("The endpoint has been banned after %d failures", i-1)
+		}
+		if _, err := ms.handlePacket(ctx, wrong, endpoint); err == nil {
+			t.Fatal("handlePacket(wrong challenge) should fail")
+		}
+	}
+
+	bans, err := ms.store.FindBans(ctx, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || !bans[0].Automatic || bans[0].Target() != endpoint.String() {
+		t.Fatalf("bans = %+v, want an automatic ban of %s", bans, endpoint)
+	}
+	if expiresIn := time.Until(bans[0].ExpiresAt); expiresIn <= 0 || expiresIn > time.Duration(ms.cfg.BanDuration)*time.Second {
+		t.Errorf("The ban expires in %s, want %d seconds", expiresIn, ms.cfg.BanDuration)
+	}
+
+	// only the endpoint is banned, it gets no reply anymore
+	if response, err := ms.handlePacket(ctx, join, endpoint); response != nil || err != nil {
+		t.Errorf("handlePacket(banned join) = %q, %v, want no reply", response, err)
+	}
+	if response, err := ms.handlePacket(ctx, join, &ServerEndpoint{IP: net.ParseIP("192.0.2.1"), Port: 27016}); response == nil || err != nil {
+		t.Errorf("handlePacket(join from another port) = %q, %v, want a challenge", response, err)
+	}
+}
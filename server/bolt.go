@@ -0,0 +1,372 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/jbltx/master-server/config"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// boltStore is a Store implementation persisted in a single bbolt file,
+// the entries are encoded with the same BSON layout as the MongoDB documents
+type boltStore struct {
+	db *bbolt.DB
+}
+
+var (
+	boltServersBucket    = []byte(config.ServersCollectionName)
+	boltChallengesBucket = []byte(config.ChallengesCollectionName)
+	boltBansBucket       = []byte(config.BansCollectionName)
+)
+
+func newBoltStore(cfg config.Config) (*boltStore, error) {
+	db, err := bbolt.Open(cfg.Database.Path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{boltServersBucket, boltChallengesBucket, boltBansBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return migrateBolt(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+// boltKey encodes an endpoint key so that the bucket order is the endpoint order
+func boltKey(key EndpointKey) []byte {
+	return []byte(key)
+}
+
+// boltLegacyKeySize is the size of the keys written before the endpoint keys,
+// they packed the port and 3 bytes of the IP address so endpoints could collide
+const boltLegacyKeySize = 8
+
+// migrateBolt converts the legacy entries, the game servers are keyed again from their
+// address and the challenges, which can't be converted and are short-lived, are removed
+func migrateBolt(tx *bbolt.Tx) error {
+	// the entries are collected first since writing while iterating moves the cursor
+	gameServers := []GameServer{}
+	legacy := [][]byte{}
+	b := tx.Bucket(boltServersBucket)
+	err := b.ForEach(func(k, v []byte) error {
+		if len(k) != boltLegacyKeySize {
+			return nil
+		}
+		var gameServer GameServer
+		if err := bson.Unmarshal(v, &gameServer); err != nil {
+			return err
+		}
+		gameServers = append(gameServers, gameServer)
+		legacy = append(legacy, append([]byte{}, k...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := range gameServers {
+		gameServer := &gameServers[i]
+		gameServer.EndpointKey = NewServerEndpoint(gameServer).Key()
+		v, err := bson.Marshal(gameServer)
+		if err != nil {
+			return err
+		}
+		if err = b.Delete(legacy[i]); err != nil {
+			return err
+		}
+		if err = b.Put(boltKey(gameServer.EndpointKey), v); err != nil {
+			return err
+		}
+	}
+
+	legacy = legacy[:0]
+	b = tx.Bucket(boltChallengesBucket)
+	err = b.ForEach(func(k, v []byte) error {
+		if len(k) == boltLegacyKeySize {
+			legacy = append(legacy, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range legacy {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) FindServers(ctx context.Context, query *ServerQuery) ([]GameServer, error) {
+	gameServers := []GameServer{}
+	after := query.After
+	if query.CollapseAddr {
+		after = after.lastOfIP()
+	}
+	seed := boltKey(after)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(boltServersBucket).Cursor()
+		k, v := c.Seek(seed)
+		if k != nil && bytes.Equal(k, seed) {
+			k, v = c.Next()
+		}
+		for ; k != nil; k, v = c.Next() {
+			if query.Limit > 0 && int64(len(gameServers)) >= query.Limit {
+				break
+			}
+			var gameServer GameServer
+			if err := bson.Unmarshal(v, &gameServer); err != nil {
+				return err
+			}
+			if gameServer.LastHeartbeatDate.Before(query.ActiveSince) {
+				continue
+			}
+			if query.IPv4Only && !gameServer.EndpointKey.IsIPv4() {
+				continue
+			}
+			if query.VisibleOnly && !gameServer.Visible {
+				continue
+			}
+			if !matchRegion(query.Region, &gameServer) || !matchFilter(query.Filter, &gameServer) {
+				continue
+			}
+			// the servers of an address are contiguous, the first one has been kept
+			if query.CollapseAddr && len(gameServers) > 0 && gameServers[len(gameServers)-1].EndpointKey.ipKey() == gameServer.EndpointKey.ipKey() {
+				continue
+			}
+			gameServers = append(gameServers, gameServer)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return gameServers, nil
+}
+
+func (s *boltStore) SaveServer(ctx context.Context, gameServer *GameServer) (bool, error) {
+	created := false
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltServersBucket)
+		key := boltKey(gameServer.EndpointKey)
+		entry := *gameServer
+		if v := b.Get(key); v != nil {
+			var previous GameServer
+			if err := bson.Unmarshal(v, &previous); err != nil {
+				return err
+			}
+			entry.FirstHeartbeatDate = previous.FirstHeartbeatDate
+			entry.HeartbeatCount = previous.HeartbeatCount + 1
+			entry.keepProbe(&previous)
+		} else {
+			entry.FirstHeartbeatDate = entry.LastHeartbeatDate
+			entry.HeartbeatCount = 1
+			created = true
+		}
+		v, err := bson.Marshal(&entry)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, v)
+	})
+	return created, err
+}
+
+func (s *boltStore) RemoveServer(ctx context.Context, endpoint *ServerEndpoint) (bool, error) {
+	removed := false
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltServersBucket)
+		key := boltKey(endpoint.Key())
+		if b.Get(key) == nil {
+			return nil
+		}
+		removed = true
+		return b.Delete(key)
+	})
+	return removed, err
+}
+
+func (s *boltStore) SaveProbe(ctx context.Context, endpoint *ServerEndpoint, result *ProbeResult) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltServersBucket)
+		key := boltKey(endpoint.Key())
+		v := b.Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		var gameServer GameServer
+		if err := bson.Unmarshal(v, &gameServer); err != nil {
+			return err
+		}
+		gameServer.applyProbe(result)
+		v, err := bson.Marshal(&gameServer)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, v)
+	})
+}
+
+func (s *boltStore) SaveChallenge(ctx context.Context, challenge *Challenge) (bool, error) {
+	created := false
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltChallengesBucket)
+		key := boltKey(challenge.EndpointKey)
+		created = b.Get(key) == nil
+		v, err := bson.Marshal(challenge)
+		if err != nil {
+			return err
+		}
+		return b.Put(key, v)
+	})
+	return created, err
+}
+
+func (s *boltStore) TakeChallenge(ctx context.Context, endpoint *ServerEndpoint) (*Challenge, error) {
+	var challenge *Challenge
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltChallengesBucket)
+		key := boltKey(endpoint.Key())
+		v := b.Get(key)
+		if v == nil {
+			return ErrNotFound
+		}
+		challenge = &Challenge{}
+		if err := bson.Unmarshal(v, challenge); err != nil {
+			return err
+		}
+		return b.Delete(key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+func (s *boltStore) SaveBan(ctx context.Context, ban *Ban) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		v, err := bson.Marshal(ban)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltBansBucket).Put([]byte(ban.Key()), v)
+	})
+}
+
+func (s *boltStore) RemoveBan(ctx context.Context, ban *Ban) (bool, error) {
+	removed := false
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(boltBansBucket)
+		key := []byte(ban.Key())
+		if b.Get(key) == nil {
+			return nil
+		}
+		removed = true
+		return b.Delete(key)
+	})
+	return removed, err
+}
+
+func (s *boltStore) FindBans(ctx context.Context, activeAt time.Time) ([]Ban, error) {
+	bans := []Ban{}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltBansBucket).ForEach(func(k, v []byte) error {
+			var ban Ban
+			if err := bson.Unmarshal(v, &ban); err != nil {
+				return err
+			}
+			if ban.IsActive(activeAt) {
+				bans = append(bans, ban)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+func (s *boltStore) PurgeExpired(ctx context.Context, serversBefore time.Time, challengesBefore time.Time, bansBefore time.Time) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		// the keys are collected first since deleting while iterating moves the cursor
+		expired := [][]byte{}
+		b := tx.Bucket(boltServersBucket)
+		err := b.ForEach(func(k, v []byte) error {
+			var gameServer GameServer
+			if err := bson.Unmarshal(v, &gameServer); err != nil {
+				return err
+			}
+			if gameServer.LastHeartbeatDate.Before(serversBefore) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		expired = expired[:0]
+		b = tx.Bucket(boltChallengesBucket)
+		err = b.ForEach(func(k, v []byte) error {
+			var challenge Challenge
+			if err := bson.Unmarshal(v, &challenge); err != nil {
+				return err
+			}
+			if challenge.UpdatedAt.Before(challengesBefore) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		expired = expired[:0]
+		b = tx.Bucket(boltBansBucket)
+		err = b.ForEach(func(k, v []byte) error {
+			var ban Ban
+			if err := bson.Unmarshal(v, &ban); err != nil {
+				return err
+			}
+			if !ban.IsActive(bansBefore) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close(ctx context.Context) error {
+	return s.db.Close()
+}
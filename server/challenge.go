@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/jbltx/master-server/config"
+)
+
+var (
+	// ErrUnknownChallenge is returned when a heartbeat answers a challenge which has never been issued
+	ErrUnknownChallenge = errors.New("The challenge hasn't been issued to this endpoint")
+	// ErrExpiredChallenge is returned when a heartbeat answers a challenge issued too long ago
+	ErrExpiredChallenge = errors.New("The challenge has expired")
+	// ErrWrongChallenge is returned when a heartbeat answers with a wrong challenge value
+	ErrWrongChallenge = errors.New("The challenge value is wrong")
+)
+
+// challenger issues the challenges sent in join replies, and verifies the heartbeats answering them
+type challenger interface {
+	Issue(ctx context.Context, endpoint *ServerEndpoint) (int32, error)
+	Verify(ctx context.Context, endpoint *ServerEndpoint, value int32) error
+}
+
+func newChallenger(cfg config.Config, store Store) (challenger, error) {
+	expiration := time.Duration(cfg.ChallengeExpiration) * time.Second
+	switch cfg.ChallengeMode {
+	case config.StatelessChallenges, "":
+		return newHMACChallenger(expiration)
+	case config.DatabaseChallenges:
+		return &storeChallenger{store: store, expiration: expiration}, nil
+	}
+	return nil, errors.New("The challenge mode " + cfg.ChallengeMode + " is unknown")
+}
+
+// storeChallenger saves every issued challenge in the store
+type storeChallenger struct {
+	store      Store
+	expiration time.Duration
+}
+
+func (c *storeChallenger) Issue(ctx context.Context, endpoint *ServerEndpoint) (int32, error) {
+	challenge := &Challenge{
+		EndpointKey: endpoint.Key(),
+		Value:       int32(mrand.Int()),
+		UpdatedAt:   time.Now(),
+	}
+	if _, err := c.store.SaveChallenge(ctx, challenge); err != nil {
+		return 0, err
+	}
+	return challenge.Value, nil
+}
+
+func (c *storeChallenger) Verify(ctx context.Context, endpoint *ServerEndpoint, value int32) error {
+	challenge, err := c.store.TakeChallenge(ctx, endpoint)
+	if err == ErrNotFound {
+		return ErrUnknownChallenge
+	}
+	if err != nil {
+		return err
+	}
+	if challenge.UpdatedAt.Before(time.Now().Add(-c.expiration)) {
+		return ErrExpiredChallenge
+	}
+	if challenge.Value != value {
+		return ErrWrongChallenge
+	}
+	return nil
+}
+
+// hmacChallenger derives the challenges from a rotating secret, the endpoint and a time bucket,
+// so nothing is written when a challenge is issued and nothing is read when it's verified.
+// A bucket lasts half of the expiration delay and the current and previous buckets are accepted,
+// the two buckets before them are recognized as expired challenges. The secret is rotated every
+// expiration delay, the previous one is kept for the pending challenges and the one before it
+// for the expired challenges only.
+type hmacChallenger struct {
+	expiration time.Duration
+	bucket     time.Duration
+
+	mu             sync.Mutex
+	secret         []byte
+	previousSecret []byte
+	expiredSecret  []byte
+	rotatedAt      time.Time
+}
+
+func newHMACChallenger(expiration time.Duration) (*hmacChallenger, error) {
+	bucket := expiration / 2
+	if bucket < time.Second {
+		bucket = time.Second
+	}
+	c := &hmacChallenger{
+		expiration: expiration,
+		bucket:     bucket,
+	}
+	if err := c.rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *hmacChallenger) rotate(now time.Time) error {
+	secret := make([]byte, sha256.Size)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	c.expiredSecret = c.previousSecret
+	c.previousSecret = c.secret
+	c.secret = secret
+	c.rotatedAt = now
+	return nil
+}
+
+// secrets returns the current, previous and expired secrets which have been generated,
+// in this order, rotating them when needed
+func (c *hmacChallenger) secrets(now time.Time) ([][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.rotatedAt) >= c.expiration {
+		if err := c.rotate(now); err != nil {
+			return nil, err
+		}
+	}
+	secrets := [][]byte{c.secret}
+	for _, secret := range [][]byte{c.previousSecret, c.expiredSecret} {
+		if secret != nil {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets, nil
+}
+
+func (c *hmacChallenger) compute(secret []byte, endpoint *ServerEndpoint, bucket int64) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(endpoint.IP.To16())
+	binary.Write(mac, binary.BigEndian, endpoint.Port)
+	binary.Write(mac, binary.BigEndian, bucket)
+	return mac.Sum(nil)[:4]
+}
+
+func (c *hmacChallenger) Issue(ctx context.Context, endpoint *ServerEndpoint) (int32, error) {
+	now := time.Now()
+	secrets, err := c.secrets(now)
+	if err != nil {
+		return 0, err
+	}
+	sum := c.compute(secrets[0], endpoint, now.UnixNano()/int64(c.bucket))
+	return int32(binary.BigEndian.Uint32(sum)), nil
+}
+
+func (c *hmacChallenger) Verify(ctx context.Context, endpoint *ServerEndpoint, value int32) error {
+	now := time.Now()
+	secrets, err := c.secrets(now)
+	if err != nil {
+		return err
+	}
+	expected := make([]byte, 4)
+	binary.BigEndian.PutUint32(expected, uint32(value))
+	bucket := now.UnixNano() / int64(c.bucket)
+	validSecrets := secrets
+	if len(validSecrets) > 2 {
+		validSecrets = validSecrets[:2]
+	}
+	for _, secret := range validSecrets {
+		for _, b := range []int64{bucket, bucket - 1} {
+			if hmac.Equal(c.compute(secret, endpoint, b), expected) {
+				return nil
+			}
+		}
+	}
+	// an honest server answering too late shouldn't be taken for a wrong answer, its challenge
+	// may have been issued just before a rotation so the expired secret is checked too
+	for _, secret := range secrets {
+		for _, b := range []int64{bucket - 2, bucket - 3} {
+			if hmac.Equal(c.compute(secret, endpoint, b), expected) {
+				return ErrExpiredChallenge
+			}
+		}
+	}
+	return ErrWrongChallenge
+}
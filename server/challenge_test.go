@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHMACChallengerVerify(t *testing.T) {
+	c, err := newHMACChallenger(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	endpoint := &ServerEndpoint{IP: net.ParseIP("192.0.2.1"), Port: 27015}
+	other := &ServerEndpoint{IP: net.ParseIP("192.0.2.1"), Port: 27016}
+
+	value, err := c.Issue(ctx, endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify(ctx, endpoint, value); err != nil {
+		t.Errorf("Verify(issued) = %v, want nil", err)
+	}
+	if err := c.Verify(ctx, other, value); err != ErrWrongChallenge {
+		t.Errorf("Verify(other endpoint) = %v, want %v", err, ErrWrongChallenge)
+	}
+
+	// the challenges of the older buckets are answered too late
+	bucket := time.Now().UnixNano() / int64(c.bucket)
+	tests := []struct {
+		bucket int64
+		want   error
+	}{
+		{bucket - 1, nil},
+		{bucket - 2, ErrExpiredChallenge},
+		{bucket - 3, ErrExpiredChallenge},
+		{bucket - 4, ErrWrongChallenge},
+	}
+	for _, tt := range tests {
+		value := int32(binary.BigEndian.Uint32(c.compute(c.secret, endpoint, tt.bucket)))
+		if err := c.Verify(ctx, endpoint, value); err != tt.want {
+			t.Errorf("Verify(bucket %d) = %v, want %v", bucket-tt.bucket, err, tt.want)
+		}
+	}
+}
+
+func TestHMACChallengerVerifyPreviousSecret(t *testing.T) {
+	c, err := newHMACChallenger(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	endpoint := &ServerEndpoint{IP: net.ParseIP("2001:db8::1"), Port: 27015}
+
+	bucket := time.Now().UnixNano() / int64(c.bucket)
+	current := int32(binary.BigEndian.Uint32(c.compute(c.secret, endpoint, bucket)))
+	expired := int32(binary.BigEndian.Uint32(c.compute(c.secret, endpoint, bucket-2)))
+	if err := c.rotate(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify(ctx, endpoint, current); err != nil {
+		t.Errorf("Verify(previous secret) = %v, want nil", err)
+	}
+	if err := c.Verify(ctx, endpoint, expired); err != ErrExpiredChallenge {
+		t.Errorf("Verify(previous secret, expired) = %v, want %v", err, ErrExpiredChallenge)
+	}
+}
+
+func TestHMACChallengerVerifyAfterTwoRotations(t *testing.T) {
+	c, err := newHMACChallenger(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	endpoint := &ServerEndpoint{IP: net.ParseIP("192.0.2.1"), Port: 27015}
+
+	// a challenge issued just before a rotation, and answered once the secret has been rotated
+	// again, between 1 and 1.5 times the expiration delay later
+	bucket := time.Now().UnixNano() / int64(c.bucket)
+	late := int32(binary.BigEndian.Uint32(c.compute(c.secret, endpoint, bucket-2)))
+	valid := int32(binary.BigEndian.Uint32(c.compute(c.secret, endpoint, bucket)))
+	for i := 0; i < 2; i++ {
+		if err := c.rotate(time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Verify(ctx, endpoint, late); err != ErrExpiredChallenge {
+		t.Errorf("Verify(late) = %v, want %v", err, ErrExpiredChallenge)
+	}
+	// the secret of two rotations ago only recognizes the expired challenges
+	if err := c.Verify(ctx, endpoint, valid); err != ErrWrongChallenge {
+		t.Errorf("Verify(current bucket, expired secret) = %v, want %v", err, ErrWrongChallenge)
+	}
+
+	if err := c.rotate(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify(ctx, endpoint, late); err != ErrWrongChallenge {
+		t.Errorf("Verify(late, forgotten secret) = %v, want %v", err, ErrWrongChallenge)
+	}
+}
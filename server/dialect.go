@@ -0,0 +1,53 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// heartbeatPorts maps the endpoints the Source servers send their heartbeats from to the
+// game endpoints they are listed on, so that their quit requests remove the right server.
+// It's only kept in memory: after a restart, a server quitting before its next heartbeat
+// is removed when its heartbeat expires, like a server which stopped without quitting.
+type heartbeatPorts struct {
+	mu      sync.Mutex
+	senders map[EndpointKey]heartbeatSender
+}
+
+type heartbeatSender struct {
+	listed ServerEndpoint
+	seen   time.Time
+}
+
+func (p *heartbeatPorts) set(sender *ServerEndpoint, listed *ServerEndpoint, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.senders == nil {
+		p.senders = make(map[EndpointKey]heartbeatSender)
+	}
+	p.senders[sender.Key()] = heartbeatSender{listed: *listed, seen: now}
+}
+
+// take returns the endpoint listed for the sender and forgets it, nil if it's unknown
+func (p *heartbeatPorts) take(sender *ServerEndpoint) *ServerEndpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := sender.Key()
+	s, found := p.senders[key]
+	if !found {
+		return nil
+	}
+	delete(p.senders, key)
+	return &s.listed
+}
+
+// purge forgets the senders without heartbeat since the given date
+func (p *heartbeatPorts) purge(before time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, s := range p.senders {
+		if s.seen.Before(before) {
+			delete(p.senders, key)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jbltx/master-server/valve"
+)
+
+const (
+	goldSrcTestHeartbeat = "0\n\\protocol\\48\\challenge\\%d\\players\\3\\max\\16\\bots\\0\\gamedir\\cstrike\\map\\de_dust2\\type\\d\\password\\0\\os\\l\\secure\\1\\lan\\0\\version\\1.1.2.7/Stdio\\region\\3\\product\\cstrike\n"
+	sourceTestHeartbeat  = "0\n\\protocol\\7\\challenge\\%d\\players\\5\\max\\24\\bots\\2\\gamedir\\tf\\map\\ctf_2fort\\password\\0\\os\\m\\lan\\0\\region\\255\\gameport\\27016\\specport\\0\\version\\8622567\\dedicated\\1\\appid\\440\\gametype\\cp,increased_maxplayers\\secure\\1\n"
+)
+
+// registerTestServer sends a join request from the endpoint and answers its challenge with the heartbeat
+func registerTestServer(t *testing.T, ms *MasterServer, endpoint *ServerEndpoint, heartbeat string) {
+	t.Helper()
+	ctx := context.Background()
+	response, err := ms.handlePacket(ctx, valve.MarshallJoinRequest(), endpoint)
+	if err != nil {
+		t.Fatalf("handlePacket(join) = %v", err)
+	}
+	challenge, err := valve.UnmarshallJoinReply(response[len(valve.ChallengeHeader):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ms.handlePacket(ctx, []byte(fmt.Sprintf(heartbeat, challenge)), endpoint); err != nil {
+		t.Fatalf("handlePacket(heartbeat) = %v", err)
+	}
+}
+
+func TestHeartbeatDialects(t *testing.T) {
+	ms := newTestMasterServer(t)
+	ctx := context.Background()
+	goldSrc := testEndpoint(t, "192.0.2.1:27015")
+	// the Source server sends its heartbeats from the Steam port, its game port is 27016
+	sourceSender := testEndpoint(t, "192.0.2.2:26900")
+
+	registerTestServer(t, ms, goldSrc, goldSrcTestHeartbeat)
+	registerTestServer(t, ms, sourceSender, sourceTestHeartbeat)
+
+	if got, want := listTestServers(t, ms, valve.AllRegions, ""), []string{"192.0.2.1:27015", "192.0.2.2:27016"}; !equalEndpoints(got, want) {
+		t.Fatalf("servers = %v, want %v", got, want)
+	}
+	if got, want := listTestServers(t, ms, valve.AllRegions, "\\appid\\440\\gametype\\cp"), []string{"192.0.2.2:27016"}; !equalEndpoints(got, want) {
+		t.Errorf("servers of the app 440 = %v, want %v", got, want)
+	}
+
+	servers, err := ms.store.FindServers(ctx, &ServerQuery{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range servers {
+		switch server.Port {
+		case 27015:
+			if server.Dialect != valve.GoldSrcDialect || server.HeartbeatPort != 0 || server.Region != valve.Europe {
+				t.Errorf("GoldSrc server = %+v", server)
+			}
+		case 27016:
+			if server.Dialect != valve.SourceDialect || server.HeartbeatPort != 26900 || server.AppID != 440 ||
+				server.OS != valve.OSX || server.Type != valve.Dedicated || server.Product != "tf" ||
+				len(server.GameType) != 2 || server.GameType[0] != "cp" {
+				t.Errorf("Source server = %+v", server)
+			}
+		}
+	}
+
+	// the quit is sent from the port of the heartbeats
+	if _, err := ms.handlePacket(ctx, valve.MarshallQuitRequest(), sourceSender); err != nil {
+		t.Fatalf("handlePacket(quit) = %v", err)
+	}
+	if got, want := listTestServers(t, ms, valve.AllRegions, ""), []string{"192.0.2.1:27015"}; !equalEndpoints(got, want) {
+		t.Errorf("servers after the quit = %v, want %v", got, want)
+	}
+}
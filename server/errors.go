@@ -0,0 +1,48 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Request names used in the logs and the request errors
+const (
+	listRequest      string = "LIST"
+	joinRequest      string = "JOIN"
+	quitRequest      string = "QUIT"
+	challengeRequest string = "CHALLENGE"
+	unknownRequest   string = "UNKNOWN"
+)
+
+// ErrMalformedRequest is wrapped by the errors caused by a packet which can't be decoded
+var ErrMalformedRequest = errors.New("The request is malformed")
+
+// RequestError is returned when a received packet can't be handled.
+// It only concerns this request, the server keeps serving the other ones.
+type RequestError struct {
+	Request  string
+	Endpoint *ServerEndpoint
+	Err      error
+}
+
+func (e *RequestError) Error() string {
+	return e.Request + " - " + e.Err.Error() + " (" + e.Endpoint.String() + ")"
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+func newRequestError(request string, endpoint *ServerEndpoint, err error) error {
+	return &RequestError{Request: request, Endpoint: endpoint, Err: err}
+}
+
+// malformed wraps a decoding error so that it matches ErrMalformedRequest
+func malformed(err error) error {
+	return fmt.Errorf("%w: %v", ErrMalformedRequest, err)
+}
+
+// isRejection checks if an error comes from a heartbeat answering a bad challenge
+func isRejection(err error) bool {
+	return errors.Is(err, ErrUnknownChallenge) || errors.Is(err, ErrExpiredChallenge) || errors.Is(err, ErrWrongChallenge)
+}
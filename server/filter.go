@@ -0,0 +1,263 @@
+package server
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/jbltx/master-server/valve"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// matchAllBSON and matchNoneBSON are the query documents for constant conditions
+var (
+	matchAllBSON  = bson.D{}
+	matchNoneBSON = bson.D{{Key: "_id", Value: bson.D{{Key: "$exists", Value: false}}}}
+)
+
+// filterToBSON converts a parsed filter string into a game-servers query document
+func filterToBSON(filter valve.Filter) bson.D {
+	return conditionsToBSON("$and", filter)
+}
+
+// regionToBSON restricts a query to the servers located in the given region
+func regionToBSON(region valve.Region) bson.D {
+	if region == valve.AllRegions {
+		return matchAllBSON
+	}
+	return bson.D{{Key: "region", Value: bson.D{{Key: "$in", Value: bson.A{region, valve.AllRegions}}}}}
+}
+
+func conditionsToBSON(operator string, conditions []valve.FilterCondition) bson.D {
+	exprs := bson.A{}
+	for _, c := range conditions {
+		expr := conditionToBSON(c)
+		if len(expr) == 0 {
+			if operator == "$or" {
+				return matchAllBSON
+			}
+			continue
+		}
+		exprs = append(exprs, expr)
+	}
+	if len(exprs) == 0 {
+		if operator == "$or" {
+			return matchNoneBSON
+		}
+		return matchAllBSON
+	}
+	if len(exprs) == 1 {
+		return exprs[0].(bson.D)
+	}
+	return bson.D{{Key: operator, Value: exprs}}
+}
+
+func flagToBSON(field string, value interface{}, enabled bool) bson.D {
+	if enabled {
+		return bson.D{{Key: field, Value: value}}
+	}
+	return bson.D{{Key: field, Value: bson.D{{Key: "$ne", Value: value}}}}
+}
+
+func conditionToBSON(c valve.FilterCondition) bson.D {
+	switch c.Key {
+	case valve.FilterNand:
+		// not all of them: fails only when every operand matches
+		if len(c.Conditions) == 0 {
+			return matchNoneBSON
+		}
+		return bson.D{{Key: "$nor", Value: bson.A{conditionsToBSON("$and", c.Conditions)}}}
+	case valve.FilterNor:
+		if len(c.Conditions) == 0 {
+			return matchAllBSON
+		}
+		return bson.D{{Key: "$nor", Value: bson.A{conditionsToBSON("$or", c.Conditions)}}}
+	case valve.FilterDedicated:
+		return flagToBSON("type", valve.Dedicated, c.Bool())
+	case valve.FilterSecure:
+		return bson.D{{Key: "secure", Value: c.Bool()}}
+	case valve.FilterGameDir:
+		return bson.D{{Key: "gameDir", Value: equalFoldRegex(c.Value)}}
+	case valve.FilterMap:
+		return bson.D{{Key: "map", Value: equalFoldRegex(c.Value)}}
+	case valve.FilterLinux:
+		return flagToBSON("os", valve.Linux, c.Bool())
+	case valve.FilterPassword:
+		return bson.D{{Key: "password", Value: c.Bool()}}
+	case valve.FilterEmpty:
+		// \empty\1 asks for servers that are not empty
+		if c.Bool() {
+			return bson.D{{Key: "players", Value: bson.D{{Key: "$gt", Value: 0}}}}
+		}
+		return bson.D{{Key: "players", Value: 0}}
+	case valve.FilterFull:
+		// \full\1 asks for servers that are not full
+		operator := "$gte"
+		if c.Bool() {
+			operator = "$lt"
+		}
+		return bson.D{{Key: "$expr", Value: bson.D{{Key: operator, Value: bson.A{"$players", "$max"}}}}}
+	case valve.FilterProxy:
+		return flagToBSON("type", valve.Proxy, c.Bool())
+	case valve.FilterAppID:
+		return bson.D{{Key: "appID", Value: c.Int()}}
+	case valve.FilterNotAppID:
+		return bson.D{{Key: "appID", Value: bson.D{{Key: "$ne", Value: c.Int()}}}}
+	case valve.FilterNoPlayers:
+		if c.Bool() {
+			return bson.D{{Key: "players", Value: 0}}
+		}
+		return bson.D{{Key: "players", Value: bson.D{{Key: "$gt", Value: 0}}}}
+	case valve.FilterWhite:
+		// this master keeps no whitelist, every registered server qualifies
+		return matchAllBSON
+	case valve.FilterGameType:
+		return bson.D{{Key: "gameType", Value: bson.D{{Key: "$all", Value: c.Tags()}}}}
+	case valve.FilterGameData:
+		return bson.D{{Key: "gameData", Value: bson.D{{Key: "$all", Value: c.Tags()}}}}
+	case valve.FilterGameDataOr:
+		return bson.D{{Key: "gameData", Value: bson.D{{Key: "$in", Value: c.Tags()}}}}
+	case valve.FilterNameMatch:
+		return bson.D{{Key: "name", Value: wildcardRegex(c.Value)}}
+	case valve.FilterVersionMatch:
+		return bson.D{{Key: "version", Value: wildcardRegex(c.Value)}}
+	case valve.FilterGameAddr:
+		ip, port := c.Addr()
+		if port == 0 {
+			return bson.D{{Key: "ip", Value: ip.String()}}
+		}
+		return bson.D{{Key: "ip", Value: ip.String()}, {Key: "port", Value: int32(port)}}
+	case valve.FilterCollapseAddrHash, valve.FilterIPv6:
+		// applied out of the filter, by ServerQuery.CollapseAddr and the reply entries size
+		return matchAllBSON
+	}
+	return matchAllBSON
+}
+
+func equalFoldRegex(value string) primitive.Regex {
+	return primitive.Regex{Pattern: "^" + regexp.QuoteMeta(value) + "$", Options: "i"}
+}
+
+func wildcardRegex(value string) primitive.Regex {
+	return primitive.Regex{Pattern: wildcardPattern(value), Options: "i"}
+}
+
+// wildcardPattern converts a filter value where * matches any sequence of characters
+// into a regular expression
+func wildcardPattern(value string) string {
+	parts := strings.Split(value, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return "^" + strings.Join(parts, ".*") + "$"
+}
+
+// matchFilter checks if a game server matches a parsed filter string,
+// it mirrors filterToBSON for the stores without a query language
+func matchFilter(filter valve.Filter, gameServer *GameServer) bool {
+	return matchAllConditions(filter, gameServer)
+}
+
+func matchAllConditions(conditions []valve.FilterCondition, gameServer *GameServer) bool {
+	for _, c := range conditions {
+		if !matchCondition(c, gameServer) {
+			return false
+		}
+	}
+	return true
+}
+
+func matchAnyCondition(conditions []valve.FilterCondition, gameServer *GameServer) bool {
+	for _, c := range conditions {
+		if matchCondition(c, gameServer) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCondition(c valve.FilterCondition, gameServer *GameServer) bool {
+	switch c.Key {
+	case valve.FilterNand:
+		return !matchAllConditions(c.Conditions, gameServer)
+	case valve.FilterNor:
+		return !matchAnyCondition(c.Conditions, gameServer)
+	case valve.FilterDedicated:
+		return (gameServer.Type == valve.Dedicated) == c.Bool()
+	case valve.FilterSecure:
+		return gameServer.Secure == c.Bool()
+	case valve.FilterGameDir:
+		return strings.EqualFold(gameServer.GameDir, c.Value)
+	case valve.FilterMap:
+		return strings.EqualFold(gameServer.Map, c.Value)
+	case valve.FilterLinux:
+		return (gameServer.OS == valve.Linux) == c.Bool()
+	case valve.FilterPassword:
+		return gameServer.Password == c.Bool()
+	case valve.FilterEmpty:
+		return (gameServer.Players > 0) == c.Bool()
+	case valve.FilterFull:
+		return (gameServer.Players < gameServer.Max) == c.Bool()
+	case valve.FilterProxy:
+		return (gameServer.Type == valve.Proxy) == c.Bool()
+	case valve.FilterAppID:
+		return gameServer.AppID == int32(c.Int())
+	case valve.FilterNotAppID:
+		return gameServer.AppID != int32(c.Int())
+	case valve.FilterNoPlayers:
+		return (gameServer.Players == 0) == c.Bool()
+	case valve.FilterGameType:
+		return containsAllTags(gameServer.GameType, c.Tags())
+	case valve.FilterGameData:
+		return containsAllTags(gameServer.GameData, c.Tags())
+	case valve.FilterGameDataOr:
+		for _, tag := range c.Tags() {
+			if containsAllTags(gameServer.GameData, []string{tag}) {
+				return true
+			}
+		}
+		return false
+	case valve.FilterNameMatch:
+		return matchWildcard(c.Value, gameServer.Name)
+	case valve.FilterVersionMatch:
+		return matchWildcard(c.Value, gameServer.Version)
+	case valve.FilterGameAddr:
+		ip, port := c.Addr()
+		if !ip.Equal(net.ParseIP(gameServer.IP)) {
+			return false
+		}
+		return port == 0 || int32(port) == gameServer.Port
+	}
+	return true
+}
+
+func containsAllTags(tags []string, wanted []string) bool {
+	for _, w := range wanted {
+		found := false
+		for _, tag := range tags {
+			if tag == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func matchWildcard(pattern string, value string) bool {
+	re, err := regexp.Compile("(?i)" + wildcardPattern(pattern))
+	if err != nil {
+		return false
+	}
+	return re.MatchString(value)
+}
+
+// matchRegion checks if a game server is listed for a query on the given region
+func matchRegion(region valve.Region, gameServer *GameServer) bool {
+	return region.Includes(gameServer.Region)
+}
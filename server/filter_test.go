@@ -0,0 +1,171 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/jbltx/master-server/valve"
+)
+
+// newFilterTestServer returns a Counter-Strike server with 10 players out of 16
+func newFilterTestServer() *GameServer {
+	return &GameServer{
+		IP:       "192.0.2.1",
+		Port:     27015,
+		Name:     "Dust2 Only | 24/7",
+		GameDir:  "cstrike",
+		Map:      "de_dust2",
+		Players:  10,
+		Max:      16,
+		Type:     valve.Dedicated,
+		OS:       valve.Linux,
+		Secure:   true,
+		Version:  "1.38.7.9",
+		AppID:    730,
+		GameType: []string{"secure", "competitive"},
+		GameData: []string{"g:csgo", "k:abc"},
+	}
+}
+
+func TestMatchFilter(t *testing.T) {
+	server := newFilterTestServer()
+	empty := *server
+	empty.Players = 0
+	full := *server
+	full.Players = 16
+
+	tests := []struct {
+		filter string
+		server *GameServer
+		want   bool
+	}{
+		{"", server, true},
+		{"\\gamedir\\CSTRIKE", server, true},
+		{"\\gamedir\\valve", server, false},
+		{"\\map\\de_dust2", server, true},
+		{"\\dedicated\\1", server, true},
+		{"\\dedicated\\0", server, false},
+		{"\\secure\\1", server, true},
+		{"\\linux\\1", server, true},
+		{"\\linux\\0", server, false},
+		{"\\password\\0", server, true},
+		{"\\proxy\\1", server, false},
+		{"\\white\\1", server, true},
+		{"\\appid\\730", server, true},
+		{"\\appid\\440", server, false},
+		{"\\napp\\440", server, true},
+		{"\\napp\\730", server, false},
+		// \empty\1 and \full\1 ask for the servers which aren't empty or full
+		{"\\empty\\1", server, true},
+		{"\\empty\\1", &empty, false},
+		{"\\empty\\0", &empty, true},
+		{"\\full\\1", server, true},
+		{"\\full\\1", &full, false},
+		{"\\full\\0", &full, true},
+		{"\\noplayers\\1", &empty, true},
+		{"\\noplayers\\1", server, false},
+		{"\\noplayers\\0", server, true},
+		{"\\gametype\\secure", server, true},
+		{"\\gametype\\competitive,secure", server, true},
+		{"\\gametype\\secure,casual", server, false},
+		{"\\gamedata\\g:csgo,k:abc", server, true},
+		{"\\gamedata\\g:csgo,k:xyz", server, false},
+		{"\\gamedataor\\k:xyz,k:abc", server, true},
+		{"\\gamedataor\\k:xyz", server, false},
+		{"\\name_match\\dust2*", server, true},
+		{"\\name_match\\*24/7", server, true},
+		{"\\name_match\\dust2", server, false},
+		{"\\name_match\\*(only)*", server, false},
+		{"\\version_match\\1.38.*", server, true},
+		{"\\version_match\\1.3?.*", server, false},
+		{"\\gameaddr\\192.0.2.1", server, true},
+		{"\\gameaddr\\192.0.2.1:27015", server, true},
+		{"\\gameaddr\\192.0.2.1:27016", server, false},
+		{"\\gameaddr\\192.0.2.2", server, false},
+		// the conditions are all required
+		{"\\gamedir\\cstrike\\map\\de_dust2", server, true},
+		{"\\gamedir\\cstrike\\map\\de_nuke", server, false},
+		// nand: not all of its conditions, nor: none of its conditions
+		{"\\nand\\2\\map\\de_dust2\\secure\\1", server, false},
+		{"\\nand\\2\\map\\de_dust2\\secure\\0", server, true},
+		{"\\nor\\2\\map\\de_nuke\\secure\\0", server, true},
+		{"\\nor\\2\\map\\de_nuke\\secure\\1", server, false},
+		{"\\nand\\0", server, false},
+		{"\\nor\\0", server, true},
+		// the conditions following a group are out of it
+		{"\\nor\\1\\map\\de_nuke\\gamedir\\cstrike", server, true},
+		{"\\nor\\1\\map\\de_nuke\\gamedir\\valve", server, false},
+		// nested groups: not (dust2 and not (no players or napp 730))
+		{"\\nand\\2\\map\\de_dust2\\nor\\2\\noplayers\\1\\napp\\730", server, false},
+		{"\\nand\\2\\map\\de_dust2\\nor\\2\\noplayers\\1\\napp\\730", &empty, true},
+		// not (not (cstrike and empty)) and linux
+		{"\\nor\\1\\nand\\2\\gamedir\\cstrike\\empty\\0\\linux\\1", server, false},
+		{"\\nor\\1\\nand\\2\\gamedir\\cstrike\\empty\\0\\linux\\1", &empty, true},
+	}
+	for _, tt := range tests {
+		filter, err := valve.ParseFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("ParseFilter(%q) error = %v", tt.filter, err)
+		}
+		if got := matchFilter(filter, tt.server); got != tt.want {
+			t.Errorf("matchFilter(%q) on %d players = %v, want %v", tt.filter, tt.server.Players, got, tt.want)
+		}
+	}
+}
+
+func TestFilterBuilderRoundTrip(t *testing.T) {
+	server := newFilterTestServer()
+	tests := []struct {
+		name    string
+		builder *valve.FilterBuilder
+		want    string
+		match   bool
+	}{
+		{"empty", valve.NewFilterBuilder(), "", true},
+		{"strings", valve.NewFilterBuilder().GameDir("cstrike").Map("de_dust2"), "\\gamedir\\cstrike\\map\\de_dust2", true},
+		{"bools", valve.NewFilterBuilder().Dedicated(true).Secure(true).Linux(true).Password(false).Proxy(false).White(true),
+			"\\dedicated\\1\\secure\\1\\linux\\1\\password\\0\\proxy\\0\\white\\1", true},
+		{"players", valve.NewFilterBuilder().Empty(true).Full(true).NoPlayers(false), "\\empty\\1\\full\\1\\noplayers\\0", true},
+		{"no players", valve.NewFilterBuilder().NoPlayers(true), "\\noplayers\\1", false},
+		{"app IDs", valve.NewFilterBuilder().AppID(730).NotAppID(440), "\\appid\\730\\napp\\440", true},
+		{"other app", valve.NewFilterBuilder().AppID(440), "\\appid\\440", false},
+		{"tags", valve.NewFilterBuilder().GameType("secure", "competitive").GameData("g:csgo").GameDataOr("k:xyz", "k:abc"),
+			"\\gametype\\secure,competitive\\gamedata\\g:csgo\\gamedataor\\k:xyz,k:abc", true},
+		{"missing tag", valve.NewFilterBuilder().GameType("secure", "casual"), "\\gametype\\secure,casual", false},
+		{"patterns", valve.NewFilterBuilder().NameMatch("dust2*").VersionMatch("1.38.*"), "\\name_match\\dust2*\\version_match\\1.38.*", true},
+		{"address", valve.NewFilterBuilder().GameAddr(net.ParseIP("192.0.2.1"), 0), "\\gameaddr\\192.0.2.1", true},
+		{"address and port", valve.NewFilterBuilder().GameAddr(net.ParseIP("192.0.2.1"), 27016), "\\gameaddr\\192.0.2.1:27016", false},
+		{"IPv6 address and port", valve.NewFilterBuilder().GameAddr(net.ParseIP("2001:db8::1"), 27015), "\\gameaddr\\[2001:db8::1]:27015", false},
+		// the reply options don't select the servers
+		{"reply options", valve.NewFilterBuilder().CollapseAddrHash(true).IPv6(true), "\\collapse_addr_hash\\1\\ipv6\\1", true},
+		{"nand", valve.NewFilterBuilder().Nand(valve.NewFilterBuilder().Map("de_dust2").Secure(true)),
+			"\\nand\\2\\map\\de_dust2\\secure\\1", false},
+		{"nor", valve.NewFilterBuilder().Nor(valve.NewFilterBuilder().Map("de_nuke").Secure(false)).GameDir("cstrike"),
+			"\\nor\\2\\map\\de_nuke\\secure\\0\\gamedir\\cstrike", true},
+		{"nested groups", valve.NewFilterBuilder().Nor(valve.NewFilterBuilder().Nand(valve.NewFilterBuilder().GameDir("cstrike").Empty(false))).Linux(true),
+			"\\nor\\1\\nand\\2\\gamedir\\cstrike\\empty\\0\\linux\\1", false},
+		{"empty group", valve.NewFilterBuilder().Nor(valve.NewFilterBuilder()), "\\nor\\0", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			built, err := tt.builder.Build()
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if got := built.String(); got != tt.want {
+				t.Fatalf("String() = %q, want %q", got, tt.want)
+			}
+			parsed, err := valve.ParseFilter(built.String())
+			if err != nil {
+				t.Fatalf("ParseFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(parsed, built) {
+				t.Errorf("ParseFilter() = %+v, want %+v", parsed, built)
+			}
+			if got := matchFilter(parsed, server); got != tt.match {
+				t.Errorf("matchFilter() = %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
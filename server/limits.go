@@ -0,0 +1,231 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jbltx/master-server/config"
+	"github.com/jbltx/master-server/valve"
+)
+
+const (
+	// maxTrackedSources caps the buckets of a rate limiter, so that a flood from spoofed
+	// addresses can't make it grow without bound. The new sources are refused when it's full.
+	maxTrackedSources = 65536
+	// Default prefix lengths of the rate limited subnets
+	defaultSubnetIPv4Prefix = 24
+	defaultSubnetIPv6Prefix = 64
+)
+
+// tokenBucket holds the tokens of a source, they are refilled at a constant rate up to the burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket since its last use and removes the cost if there are enough tokens
+func (b *tokenBucket) take(now time.Time, rate float64, burst float64, cost float64) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < cost {
+		return false
+	}
+	b.tokens -= cost
+	return true
+}
+
+// rateLimiter gives a token bucket to each source, a nil rateLimiter allows everything
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu       sync.Mutex
+	buckets  map[string]*tokenBucket
+	purgedAt time.Time
+}
+
+func newRateLimiter(rate uint32, burst uint32) *rateLimiter {
+	if rate == 0 {
+		return nil
+	}
+	if burst == 0 {
+		burst = rate
+	}
+	return &rateLimiter{
+		rate:    float64(rate),
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of the source
+func (l *rateLimiter) allow(source string, now time.Time) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, found := l.buckets[source]
+	if !found {
+		if len(l.buckets) >= maxTrackedSources {
+			// purging is costly, it's done at most once a second during a flood
+			if now.Sub(l.purgedAt) < time.Second {
+				return false
+			}
+			l.purgeLocked(now)
+			if len(l.buckets) >= maxTrackedSources {
+				return false
+			}
+		}
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[source] = bucket
+	}
+	return bucket.take(now, l.rate, l.burst, 1)
+}
+
+// refund gives back the token taken by allow for a packet refused by another limiter
+func (l *rateLimiter) refund(source string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if bucket, found := l.buckets[source]; found && bucket.tokens+1 <= l.burst {
+		bucket.tokens++
+	}
+}
+
+// purge forgets the sources whose bucket is full again, they are like new ones
+func (l *rateLimiter) purge(now time.Time) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.purgeLocked(now)
+}
+
+func (l *rateLimiter) purgeLocked(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for source, bucket := range l.buckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(l.buckets, source)
+		}
+	}
+	l.purgedAt = now
+}
+
+// packetLimiter limits a request type for each IP address and for each subnet
+type packetLimiter struct {
+	ip     *rateLimiter
+	subnet *rateLimiter
+}
+
+func newPacketLimiter(cfg config.RateLimitConfig) *packetLimiter {
+	return &packetLimiter{
+		ip:     newRateLimiter(cfg.Rate, cfg.Burst),
+		subnet: newRateLimiter(cfg.SubnetRate, cfg.SubnetBurst),
+	}
+}
+
+// limits applies the rate limits to the received packets, before they are queued,
+// and the global budget to the reply bytes. The budget bounds what the master server
+// can send to spoofed addresses whatever the number of sources.
+type limits struct {
+	packets  map[byte]*packetLimiter
+	ipv4Mask net.IPMask
+	ipv6Mask net.IPMask
+
+	// responses is nil when the reply bytes are unlimited
+	responses     *tokenBucket
+	responseRate  float64
+	responseBurst float64
+	responsesMu   sync.Mutex
+}
+
+func newLimits(cfg config.Config) *limits {
+	ipv4Prefix := int(cfg.Limits.SubnetIPv4Prefix)
+	if ipv4Prefix == 0 {
+		ipv4Prefix = defaultSubnetIPv4Prefix
+	}
+	ipv6Prefix := int(cfg.Limits.SubnetIPv6Prefix)
+	if ipv6Prefix == 0 {
+		ipv6Prefix = defaultSubnetIPv6Prefix
+	}
+	l := &limits{
+		packets: map[byte]*packetLimiter{
+			valve.RequestServerListHeader: newPacketLimiter(cfg.Limits.List),
+			valve.RequestJoinHeader:       newPacketLimiter(cfg.Limits.Join),
+			valve.RequestQuitHeader:       newPacketLimiter(cfg.Limits.Quit),
+			valve.RequestChallengeHeader:  newPacketLimiter(cfg.Limits.Challenge),
+		},
+		ipv4Mask: net.CIDRMask(ipv4Prefix, 32),
+		ipv6Mask: net.CIDRMask(ipv6Prefix, 128),
+	}
+	if cfg.Limits.ResponseBytes > 0 {
+		burst := cfg.Limits.ResponseBurst
+		if burst == 0 {
+			burst = cfg.Limits.ResponseBytes
+		}
+		// the biggest reply has to fit in the bucket or it would never be sent
+		packetSize := uint32(cfg.MaxPacketSize)
+		if packetSize == 0 {
+			packetSize = uint32(config.DefaultMaxPacketSize)
+		}
+		if burst < packetSize {
+			burst = packetSize
+		}
+		l.responseRate = float64(cfg.Limits.ResponseBytes)
+		l.responseBurst = float64(burst)
+		l.responses = &tokenBucket{tokens: l.responseBurst, last: time.Now()}
+	}
+	return l
+}
+
+// allowPacket checks the rate limits of the packet type for the source address, the subnet
+// first so that the packets refused for their subnet don't spend the tokens of their address.
+// The unknown packet types aren't limited since they get no reply.
+func (l *limits) allowPacket(header byte, ip net.IP, now time.Time) bool {
+	limiter, found := l.packets[header]
+	if !found {
+		return true
+	}
+	var subnet net.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		subnet = ip4.Mask(l.ipv4Mask)
+	} else {
+		subnet = ip.Mask(l.ipv6Mask)
+	}
+	if !limiter.subnet.allow(string(subnet), now) {
+		return false
+	}
+	if !limiter.ip.allow(string(ip), now) {
+		// a flooding address doesn't use up the tokens of its subnet neighbours
+		limiter.subnet.refund(string(subnet))
+		return false
+	}
+	return true
+}
+
+// allowResponse spends the size of a reply from the global budget
+func (l *limits) allowResponse(size int, now time.Time) bool {
+	if l.responses == nil {
+		return true
+	}
+	l.responsesMu.Lock()
+	defer l.responsesMu.Unlock()
+	return l.responses.take(now, l.responseRate, l.responseBurst, float64(size))
+}
+
+// purge forgets the idle sources
+func (l *limits) purge(now time.Time) {
+	for _, limiter := range l.packets {
+		limiter.ip.purge(now)
+		limiter.subnet.purge(now)
+	}
+}
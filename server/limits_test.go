@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jbltx/master-server/config"
+	"github.com/jbltx/master-server/valve"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter(2, 4)
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		if !l.allow("a", now) {
+			t.Fatalf("allow() = false for the token %d of the burst", i+1)
+		}
+	}
+	if l.allow("a", now) {
+		t.Fatal("allow() = true after the burst")
+	}
+	// each source has its own bucket
+	if !l.allow("b", now) {
+		t.Error("allow(other source) = false")
+	}
+	// 2 tokens a second, up to the burst
+	if !l.allow("a", now.Add(500*time.Millisecond)) || l.allow("a", now.Add(500*time.Millisecond)) {
+		t.Error("One token should be refilled after half a second")
+	}
+	later := now.Add(time.Hour)
+	for i := 0; i < 4; i++ {
+		if !l.allow("a", later) {
+			t.Fatalf("allow() = false for the token %d after an hour", i+1)
+		}
+	}
+	if l.allow("a", later) {
+		t.Error("The bucket has been refilled over its burst")
+	}
+
+	// the full buckets are forgotten
+	l.purge(later.Add(2 * time.Second))
+	if len(l.buckets) != 0 {
+		t.Errorf("purge() kept %d buckets", len(l.buckets))
+	}
+
+	// a zero rate disables the limiter
+	var disabled *rateLimiter = newRateLimiter(0, 10)
+	for i := 0; i < 100; i++ {
+		if !disabled.allow("a", now) {
+			t.Fatal("A disabled limiter refused a packet")
+		}
+	}
+}
+
+func newTestLimits(list config.RateLimitConfig) *limits {
+	cfg := config.NewDefaultConfig()
+	cfg.Limits.List = list
+	return newLimits(cfg)
+}
+
+func TestLimitsAllowPacketSubnet(t *testing.T) {
+	l := newTestLimits(config.RateLimitConfig{Rate: 1, Burst: 2, SubnetRate: 1, SubnetBurst: 3})
+	now := time.Now()
+	a := net.ParseIP("192.0.2.1")
+	b := net.ParseIP("192.0.2.2")
+	other := net.ParseIP("192.0.3.1")
+
+	// a flooding address is refused by its own bucket, without spending the tokens of its subnet
+	for i := 0; i < 10; i++ {
+		if got, want := l.allowPacket(valve.RequestServerListHeader, a, now), i < 2; got != want {
+			t.Fatalf("allowPacket(a) %d = %v, want %v", i, got, want)
+		}
+	}
+	if !l.allowPacket(valve.RequestServerListHeader, b, now) {
+		t.Fatal("allowPacket(b) = false, the subnet has a token left")
+	}
+
+	// the subnet is out of tokens, its addresses are refused without spending their own
+	for i := 0; i < 10; i++ {
+		if l.allowPacket(valve.RequestServerListHeader, b, now) {
+			t.Fatalf("allowPacket(b) %d = true, the subnet is out of tokens", i)
+		}
+	}
+	limiter := l.packets[valve.RequestServerListHeader]
+	if bucket := limiter.ip.buckets[string(b.To4())]; bucket == nil || bucket.tokens != 1 {
+		t.Errorf("the bucket of b = %+v, want 1 token left", bucket)
+	}
+	if !l.allowPacket(valve.RequestServerListHeader, other, now) {
+		t.Error("allowPacket(other subnet) = false")
+	}
+
+	// the IPv6 subnets are /64 networks
+	v6 := net.ParseIP("2001:db8::1")
+	for i := 0; i < 2; i++ {
+		l.allowPacket(valve.RequestServerListHeader, v6, now)
+	}
+	if !l.allowPacket(valve.RequestServerListHeader, net.ParseIP("2001:db8::2"), now) {
+		t.Error("allowPacket(IPv6 neighbour) = false, the subnet has a token left")
+	}
+	if l.allowPacket(valve.RequestServerListHeader, net.ParseIP("2001:db8::3"), now) {
+		t.Error("allowPacket(IPv6 neighbour) = true, the subnet is out of tokens")
+	}
+	if !l.allowPacket(valve.RequestServerListHeader, net.ParseIP("2001:db8:0:1::1"), now) {
+		t.Error("allowPacket(other IPv6 subnet) = false")
+	}
+
+	// the packets without reply aren't limited
+	for i := 0; i < 10; i++ {
+		if !l.allowPacket(0x00, a, now) {
+			t.Fatal("allowPacket(unknown header) = false")
+		}
+	}
+}
+
+func TestLimitsAllowResponse(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	cfg.Limits.ResponseBytes = 1000
+	cfg.Limits.ResponseBurst = 2000
+	l := newLimits(cfg)
+	now := time.Now()
+	if !l.allowResponse(1400, now) || l.allowResponse(1400, now) {
+		t.Error("The burst should hold a single 1400 bytes reply")
+	}
+	if !l.allowResponse(1400, now.Add(time.Second)) {
+		t.Error("The reply budget should be refilled after a second")
+	}
+}
+
+func newHandshakeTestServer(t *testing.T) *MasterServer {
+	t.Helper()
+	// every server list reply needs the handshake
+	ms := newTestMasterServerWith(t, newMemoryStore(), func(cfg *config.Config) {
+		cfg.Limits.ListHandshakeSize = uint16(len(valve.ServerListHeader))
+	})
+	saveTestServer(t, ms, testEndpoint(t, "192.0.2.1:27015"), valve.Europe)
+	return ms
+}
+
+func TestListHandshake(t *testing.T) {
+	ms := newHandshakeTestServer(t)
+	ctx := context.Background()
+	client := testEndpoint(t, "198.51.100.1:50000")
+	request := &valve.ServerListRequest{Region: valve.AllRegions, Seed: valve.NullSeed}
+	packet, err := valve.MarshallServerListRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the list is only sent to the clients answering the challenge
+	response, err := ms.handlePacket(ctx, packet, client)
+	if err != nil || !bytes.HasPrefix(response, valve.ChallengeHeader) {
+		t.Fatalf("handlePacket(list) = %q, %v, want a challenge", response, err)
+	}
+	if len(response) > len(packet) {
+		t.Errorf("The challenge is %d bytes for a %d bytes request", len(response), len(packet))
+	}
+	challenge, err := valve.UnmarshallJoinReply(response[len(valve.ChallengeHeader):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Challenge = &challenge
+	answered, err := valve.MarshallServerListRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = ms.handlePacket(ctx, answered, client)
+	if err != nil || !bytes.HasPrefix(response, valve.ServerListHeader) {
+		t.Fatalf("handlePacket(answered list) = %q, %v, want a server list", response, err)
+	}
+
+	// the challenge of a client doesn't answer the handshake of another one
+	response, err = ms.handlePacket(ctx, answered, testEndpoint(t, "198.51.100.2:50000"))
+	if err != nil || !bytes.HasPrefix(response, valve.ChallengeHeader) {
+		t.Errorf("handlePacket(list with the challenge of another client) = %q, %v, want a new challenge", response, err)
+	}
+	// nor does the challenge of a join request
+	join, err := ms.handlePacket(ctx, valve.MarshallJoinRequest(), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinChallenge, err := valve.UnmarshallJoinReply(join[len(valve.ChallengeHeader):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Challenge = &joinChallenge
+	withJoinChallenge, err := valve.MarshallServerListRequest(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err = ms.handlePacket(ctx, withJoinChallenge, client)
+	if err != nil || !bytes.HasPrefix(response, valve.ChallengeHeader) {
+		t.Errorf("handlePacket(list with a join challenge) = %q, %v, want a new challenge", response, err)
+	}
+	if got := ms.Stats().Handshakes; got != 3 {
+		t.Errorf("Stats().Handshakes = %d, want 3", got)
+	}
+}
+
+func TestListHandshakeDropsShortRequests(t *testing.T) {
+	ms := newHandshakeTestServer(t)
+	ctx := context.Background()
+	client := testEndpoint(t, "198.51.100.1:50000")
+
+	// the requests smaller than the challenge reply get nothing, whatever their filter or seed
+	for _, packet := range []string{"1\xff", "1\xff\x00", "1\xff\x00\x00", "1\xff\\nor\\0"} {
+		if len(packet) >= listHandshakeReplySize {
+			t.Fatalf("The request %q isn't smaller than the challenge reply", packet)
+		}
+		response, err := ms.handlePacket(ctx, []byte(packet), client)
+		if response != nil || !errors.Is(err, ErrMalformedRequest) {
+			t.Errorf("handlePacket(%q) = %q, %v, want no reply", packet, response, err)
+		}
+	}
+	if got := ms.Stats().Handshakes; got != 0 {
+		t.Errorf("Stats().Handshakes = %d, want 0", got)
+	}
+
+	// the shortest complete request is answered
+	response, err := ms.handlePacket(ctx, []byte("1\xff0.0.0.0:0\x00\x00"), client)
+	if err != nil || !bytes.HasPrefix(response, valve.ChallengeHeader) {
+		t.Errorf("handlePacket(complete request) = %q, %v, want a challenge", response, err)
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore is a Store implementation keeping everything in memory,
+// for single-node and test deployments
+type memoryStore struct {
+	mu sync.RWMutex
+	// servers are sorted by endpoint key for the seed paging
+	servers    []GameServer
+	challenges map[EndpointKey]Challenge
+	bans       map[string]Ban
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		servers:    []GameServer{},
+		challenges: make(map[EndpointKey]Challenge),
+		bans:       make(map[string]Ban),
+	}
+}
+
+// searchServer returns the index of the first server with an endpoint key greater or equal to key
+func (s *memoryStore) searchServer(key EndpointKey) int {
+	return sort.Search(len(s.servers), func(i int) bool {
+		return s.servers[i].EndpointKey >= key
+	})
+}
+
+func (s *memoryStore) FindServers(ctx context.Context, query *ServerQuery) ([]GameServer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	gameServers := []GameServer{}
+	after := query.After
+	if query.CollapseAddr {
+		after = after.lastOfIP()
+	}
+	i := s.searchServer(after)
+	if i < len(s.servers) && s.servers[i].EndpointKey == after {
+		i++
+	}
+	for ; i < len(s.servers); i++ {
+		if query.Limit > 0 && int64(len(gameServers)) >= query.Limit {
+			break
+		}
+		gameServer := &s.servers[i]
+		if gameServer.LastHeartbeatDate.Before(query.ActiveSince) {
+			continue
+		}
+		if query.IPv4Only && !gameServer.EndpointKey.IsIPv4() {
+			continue
+		}
+		if query.VisibleOnly && !gameServer.Visible {
+			continue
+		}
+		if !matchRegion(query.Region, gameServer) || !matchFilter(query.Filter, gameServer) {
+			continue
+		}
+		// the servers of an address are contiguous, the first one has been kept
+		if query.CollapseAddr && len(gameServers) > 0 && gameServers[len(gameServers)-1].EndpointKey.ipKey() == gameServer.EndpointKey.ipKey() {
+			continue
+		}
+		gameServers = append(gameServers, *gameServer)
+	}
+	return gameServers, nil
+}
+
+func (s *memoryStore) SaveServer(ctx context.Context, gameServer *GameServer) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := *gameServer
+	i := s.searchServer(entry.EndpointKey)
+	if i < len(s.servers) && s.servers[i].EndpointKey == entry.EndpointKey {
+		entry.FirstHeartbeatDate = s.servers[i].FirstHeartbeatDate
+		entry.HeartbeatCount = s.servers[i].HeartbeatCount + 1
+		entry.keepProbe(&s.servers[i])
+		s.servers[i] = entry
+		return false, nil
+	}
+
+	entry.FirstHeartbeatDate = entry.LastHeartbeatDate
+	entry.HeartbeatCount = 1
+	s.servers = append(s.servers, GameServer{})
+	copy(s.servers[i+1:], s.servers[i:])
+	s.servers[i] = entry
+	return true, nil
+}
+
+func (s *memoryStore) RemoveServer(ctx context.Context, endpoint *ServerEndpoint) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := endpoint.Key()
+	i := s.searchServer(key)
+	if i == len(s.servers) || s.servers[i].EndpointKey != key {
+		return false, nil
+	}
+	s.servers = append(s.servers[:i], s.servers[i+1:]...)
+	return true, nil
+}
+
+func (s *memoryStore) SaveProbe(ctx context.Context, endpoint *ServerEndpoint, result *ProbeResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := endpoint.Key()
+	i := s.searchServer(key)
+	if i == len(s.servers) || s.servers[i].EndpointKey != key {
+		return ErrNotFound
+	}
+	s.servers[i].applyProbe(result)
+	return nil
+}
+
+func (s *memoryStore) SaveChallenge(ctx context.Context, challenge *Challenge) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, found := s.challenges[challenge.EndpointKey]
+	s.challenges[challenge.EndpointKey] = *challenge
+	return !found, nil
+}
+
+func (s *memoryStore) TakeChallenge(ctx context.Context, endpoint *ServerEndpoint) (*Challenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := endpoint.Key()
+	challenge, found := s.challenges[key]
+	if !found {
+		return nil, ErrNotFound
+	}
+	delete(s.challenges, key)
+	return &challenge, nil
+}
+
+func (s *memoryStore) SaveBan(ctx context.Context, ban *Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bans[ban.Key()] = *ban
+	return nil
+}
+
+func (s *memoryStore) RemoveBan(ctx context.Context, ban *Ban) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ban.Key()
+	_, found := s.bans[key]
+	delete(s.bans, key)
+	return found, nil
+}
+
+func (s *memoryStore) FindBans(ctx context.Context, activeAt time.Time) ([]Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	bans := []Ban{}
+	for _, ban := range s.bans {
+		if ban.IsActive(activeAt) {
+			bans = append(bans, ban)
+		}
+	}
+	return bans, nil
+}
+
+func (s *memoryStore) PurgeExpired(ctx context.Context, serversBefore time.Time, challengesBefore time.Time, bansBefore time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	servers := s.servers[:0]
+	for _, gameServer := range s.servers {
+		if !gameServer.LastHeartbeatDate.Before(serversBefore) {
+			servers = append(servers, gameServer)
+		}
+	}
+	s.servers = servers
+
+	for key, challenge := range s.challenges {
+		if challenge.UpdatedAt.Before(challengesBefore) {
+			delete(s.challenges, key)
+		}
+	}
+
+	for key, ban := range s.bans {
+		if !ban.IsActive(bansBefore) {
+			delete(s.bans, key)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Close(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,338 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/jbltx/master-server/config"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoStore is the Store implementation backed by a MongoDB database
+type mongoStore struct {
+	client                *mongo.Client
+	gameServersCollection *mongo.Collection
+	challengesCollection  *mongo.Collection
+	bansCollection        *mongo.Collection
+}
+
+func newMongoStore(ctx context.Context, cfg config.Config) (*mongoStore, error) {
+	mongoClient, err := mongo.NewClient(options.Client().ApplyURI(cfg.Database.URL))
+	if err != nil {
+		return nil, err
+	}
+	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err = mongoClient.Connect(connectCtx); err != nil {
+		return nil, err
+	}
+
+	db := mongoClient.Database(cfg.Database.Name)
+	if err = migrateDatabase(ctx, db); err != nil {
+		log.Println("[WARN] Unable to migrate the database documents: " + err.Error())
+	}
+	if err = setupDatabase(connectCtx, db, cfg); err != nil {
+		log.Println("[WARN] Unable to setup the database indices: " + err.Error())
+	}
+
+	return &mongoStore{
+		client:                mongoClient,
+		gameServersCollection: db.Collection(config.ServersCollectionName),
+		challengesCollection:  db.Collection(config.ChallengesCollectionName),
+		bansCollection:        db.Collection(config.BansCollectionName),
+	}, nil
+}
+
+// setupDatabase creates the collections indices. The TTL indices let MongoDB remove
+// the expired heartbeats, challenges and bans, the handlers still check the dates
+// since the TTL monitor only runs every minute.
+func setupDatabase(ctx context.Context, db *mongo.Database, cfg config.Config) error {
+	serversCollectionIndices := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "endpointKey", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "lastHeartbeatDate", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(cfg.HeartbeatExpiration),
+		},
+	}
+	opts := options.CreateIndexes().SetMaxTime(2 * time.Second)
+	_, err := db.Collection(config.ServersCollectionName).Indexes().CreateMany(ctx, serversCollectionIndices, opts)
+	if err != nil {
+		return err
+	}
+
+	challengesCollectionIndices := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "endpointKey", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "updatedAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(cfg.ChallengeExpiration),
+		},
+	}
+	_, err = db.Collection(config.ChallengesCollectionName).Indexes().CreateMany(ctx, challengesCollectionIndices, opts)
+	if err != nil {
+		return err
+	}
+
+	bansCollectionIndices := []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "network", Value: 1}, {Key: "port", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// the permanent bans have no expiration date and are kept
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	}
+	_, err = db.Collection(config.BansCollectionName).Indexes().CreateMany(ctx, bansCollectionIndices, opts)
+	return err
+}
+
+// migrateDatabase converts the documents written before the endpoint keys. The legacy
+// endpointID packed the port and 3 bytes of the IP address in an integer, so different
+// endpoints could collide. The game servers keys are computed from their address, the
+// legacy challenges can't be converted and are short-lived, so they are removed.
+func migrateDatabase(ctx context.Context, db *mongo.Database) error {
+	legacy := bson.D{{Key: "endpointKey", Value: bson.D{{Key: "$exists", Value: false}}}}
+	for _, name := range []string{config.ServersCollectionName, config.ChallengesCollectionName} {
+		// the legacy unique index would reject the documents without an endpointID
+		db.Collection(name).Indexes().DropOne(ctx, "endpointID_1")
+	}
+
+	serversCollection := db.Collection(config.ServersCollectionName)
+	cursor, err := serversCollection.Find(ctx, legacy)
+	if err != nil {
+		return err
+	}
+	gameServers := []GameServer{}
+	if err = cursor.All(ctx, &gameServers); err != nil {
+		return err
+	}
+	for i := range gameServers {
+		gameServer := &gameServers[i]
+		update := bson.D{
+			{Key: "$set", Value: bson.D{{Key: "endpointKey", Value: NewServerEndpoint(gameServer).Key()}}},
+			{Key: "$unset", Value: bson.D{{Key: "endpointID", Value: ""}}},
+		}
+		if _, err = serversCollection.UpdateOne(ctx, bson.D{{Key: "_id", Value: gameServer.ID}}, update); err != nil {
+			return err
+		}
+	}
+	if len(gameServers) > 0 {
+		log.Printf("[INFO] %d game servers migrated to the endpoint keys\n", len(gameServers))
+	}
+
+	_, err = db.Collection(config.ChallengesCollectionName).DeleteMany(ctx, legacy)
+	return err
+}
+
+func (s *mongoStore) FindServers(ctx context.Context, query *ServerQuery) ([]GameServer, error) {
+	after := query.After
+	if query.CollapseAddr {
+		after = after.lastOfIP()
+	}
+	endpointKey := bson.D{{Key: "$gt", Value: after}}
+	if query.IPv4Only {
+		endpointKey = append(endpointKey, bson.E{Key: "$regex", Value: primitive.Regex{Pattern: "^" + ipv4KeyPrefix}})
+	}
+	filter := bson.D{
+		{Key: "endpointKey", Value: endpointKey},
+		{Key: "lastHeartbeatDate", Value: bson.D{{Key: "$gte", Value: query.ActiveSince}}},
+	}
+	if query.VisibleOnly {
+		filter = append(filter, bson.E{Key: "visible", Value: true})
+	}
+	filter = append(filter, regionToBSON(query.Region)...)
+	filter = append(filter, filterToBSON(query.Filter)...)
+
+	var cursor *mongo.Cursor
+	var err error
+	sortByKey := bson.D{{Key: "$sort", Value: bson.D{{Key: "endpointKey", Value: 1}}}}
+	if query.CollapseAddr {
+		// the first server of each address, grouped by the IP address part of the keys
+		pipeline := mongo.Pipeline{
+			{{Key: "$match", Value: filter}},
+			sortByKey,
+			{{Key: "$group", Value: bson.D{
+				{Key: "_id", Value: bson.D{{Key: "$substrBytes", Value: bson.A{"$endpointKey", 0, endpointKeyIPLength}}}},
+				{Key: "server", Value: bson.D{{Key: "$first", Value: "$$ROOT"}}},
+			}}},
+			{{Key: "$replaceRoot", Value: bson.D{{Key: "newRoot", Value: "$server"}}}},
+			sortByKey,
+		}
+		if query.Limit > 0 {
+			pipeline = append(pipeline, bson.D{{Key: "$limit", Value: query.Limit}})
+		}
+		cursor, err = s.gameServersCollection.Aggregate(ctx, pipeline)
+	} else {
+		opts := options.Find().SetSort(bson.D{{Key: "endpointKey", Value: 1}}).SetLimit(query.Limit)
+		cursor, err = s.gameServersCollection.Find(ctx, filter, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	gameServers := []GameServer{}
+	if err = cursor.All(ctx, &gameServers); err != nil {
+		return nil, err
+	}
+	return gameServers, nil
+}
+
+func (s *mongoStore) SaveServer(ctx context.Context, gameServer *GameServer) (bool, error) {
+	opts := options.Update().SetUpsert(true) // create a new document if not already here
+	filter := bson.D{{Key: "endpointKey", Value: gameServer.EndpointKey}}
+	// every heartbeat replaces the whole metadata, so a value going back to zero is stored too,
+	// while the first heartbeat date is only written when the document is created
+	update := bson.D{
+		{Key: "$set", Value: gameServer},
+		{Key: "$setOnInsert", Value: bson.D{{Key: "firstHeartbeatDate", Value: gameServer.LastHeartbeatDate}}},
+		{Key: "$inc", Value: bson.D{{Key: "heartbeatCount", Value: 1}}},
+	}
+	res, err := s.gameServersCollection.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return false, err
+	}
+	return res.UpsertedCount > 0, nil
+}
+
+func (s *mongoStore) RemoveServer(ctx context.Context, endpoint *ServerEndpoint) (bool, error) {
+	res, err := s.gameServersCollection.DeleteOne(ctx, bson.D{{Key: "endpointKey", Value: endpoint.Key()}})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+func (s *mongoStore) SaveProbe(ctx context.Context, endpoint *ServerEndpoint, result *ProbeResult) error {
+	filter := bson.D{{Key: "endpointKey", Value: endpoint.Key()}}
+	var update bson.D
+	if result.Info == nil {
+		update = bson.D{
+			{Key: "$set", Value: bson.D{{Key: "probeDate", Value: result.Date}}},
+			{Key: "$inc", Value: bson.D{{Key: "probeFailures", Value: 1}}},
+		}
+	} else {
+		var probed GameServer
+		probed.applyProbe(result)
+		update = bson.D{
+			{Key: "$set", Value: bson.D{
+				{Key: "name", Value: probed.Name},
+				{Key: "gameDir", Value: probed.GameDir},
+				{Key: "map", Value: probed.Map},
+				{Key: "players", Value: probed.Players},
+				{Key: "max", Value: probed.Max},
+				{Key: "bots", Value: probed.Bots},
+				{Key: "type", Value: probed.Type},
+				{Key: "os", Value: probed.OS},
+				{Key: "password", Value: probed.Password},
+				{Key: "secure", Value: probed.Secure},
+				{Key: "version", Value: probed.Version},
+				{Key: "appID", Value: probed.AppID},
+				{Key: "gameType", Value: probed.GameType},
+				{Key: "visible", Value: true},
+				{Key: "probeDate", Value: probed.ProbeDate},
+			}},
+			{Key: "$unset", Value: bson.D{{Key: "probeFailures", Value: ""}}},
+		}
+	}
+	res, err := s.gameServersCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	if result.Info != nil {
+		return nil
+	}
+	// a server is hidden once it missed too many probes in a row
+	filter = append(filter, bson.E{Key: "probeFailures", Value: bson.D{{Key: "$gte", Value: maxProbeFailures}}})
+	update = bson.D{{Key: "$set", Value: bson.D{{Key: "visible", Value: false}}}}
+	_, err = s.gameServersCollection.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (s *mongoStore) SaveChallenge(ctx context.Context, challenge *Challenge) (bool, error) {
+	opts := options.Update().SetUpsert(true) // create a new document if not already here
+	filter := bson.D{{Key: "endpointKey", Value: challenge.EndpointKey}}
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "value", Value: challenge.Value}, {Key: "updatedAt", Value: challenge.UpdatedAt}}}}
+	res, err := s.challengesCollection.UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		return false, err
+	}
+	return res.UpsertedCount > 0, nil
+}
+
+func (s *mongoStore) TakeChallenge(ctx context.Context, endpoint *ServerEndpoint) (*Challenge, error) {
+	filter := bson.D{{Key: "endpointKey", Value: endpoint.Key()}}
+	var challenge Challenge
+	err := s.challengesCollection.FindOneAndDelete(ctx, filter).Decode(&challenge)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+func (s *mongoStore) SaveBan(ctx context.Context, ban *Ban) error {
+	opts := options.Replace().SetUpsert(true) // create a new document if not already here
+	filter := bson.D{{Key: "network", Value: ban.Network}, {Key: "port", Value: ban.Port}}
+	_, err := s.bansCollection.ReplaceOne(ctx, filter, ban, opts)
+	return err
+}
+
+func (s *mongoStore) RemoveBan(ctx context.Context, ban *Ban) (bool, error) {
+	filter := bson.D{{Key: "network", Value: ban.Network}, {Key: "port", Value: ban.Port}}
+	res, err := s.bansCollection.DeleteOne(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
+
+func (s *mongoStore) FindBans(ctx context.Context, activeAt time.Time) ([]Ban, error) {
+	filter := bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "expiresAt", Value: bson.D{{Key: "$exists", Value: false}}}},
+		bson.D{{Key: "expiresAt", Value: bson.D{{Key: "$gt", Value: activeAt}}}},
+	}}}
+	cursor, err := s.bansCollection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	bans := []Ban{}
+	if err = cursor.All(ctx, &bans); err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+func (s *mongoStore) PurgeExpired(ctx context.Context, serversBefore time.Time, challengesBefore time.Time, bansBefore time.Time) error {
+	// the TTL indices already do it, this only makes the removal happen on time
+	filter := bson.D{{Key: "lastHeartbeatDate", Value: bson.D{{Key: "$lt", Value: serversBefore}}}}
+	if _, err := s.gameServersCollection.DeleteMany(ctx, filter); err != nil {
+		return err
+	}
+	filter = bson.D{{Key: "updatedAt", Value: bson.D{{Key: "$lt", Value: challengesBefore}}}}
+	if _, err := s.challengesCollection.DeleteMany(ctx, filter); err != nil {
+		return err
+	}
+	filter = bson.D{{Key: "expiresAt", Value: bson.D{{Key: "$lte", Value: bansBefore}}}}
+	_, err := s.bansCollection.DeleteMany(ctx, filter)
+	return err
+}
+
+func (s *mongoStore) Close(ctx context.Context) error {
+	return s.client.Disconnect(ctx)
+}
@@ -4,11 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jbltx/master-server/valve"
@@ -16,39 +21,202 @@ import (
 	"github.com/jbltx/master-server/config"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
-
-	"go.mongodb.org/mongo-driver/bson"
-
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-var gameServersCollection *mongo.Collection
-var challengesCollection *mongo.Collection
+// ErrServerClosed is returned by Listen once the server has been shut down
+var ErrServerClosed = errors.New("The master server has been shut down")
+
+// maxRequestSize is the standard MTU size, no request should be bigger
+const maxRequestSize = 1600
 
 type MasterServer struct {
-	cfg config.Config
+	// stats is first to keep its counters 64-bit aligned for the atomic operations
+	stats      Stats
+	cfg        config.Config
+	store      Store
+	challenger challenger
+	// verifier is nil when the game servers are listed without being probed
+	verifier *verifier
+	bans     banList
+	// challengeFailures is nil when the automatic bans are disabled
+	challengeFailures *challengeFailures
+	limits            *limits
+	heartbeatPorts    heartbeatPorts
+	// listHandshake issues the challenges answered by the clients before they get
+	// a large server list, it's nil when the handshake is disabled
+	listHandshake challenger
+
+	// handlersCtx is given to the handlers, it's only canceled when a shutdown takes too long
+	handlersCtx    context.Context
+	cancelHandlers context.CancelFunc
+
+	mu         sync.Mutex
+	connection *net.UDPConn
+	closing    bool
+	// listenDone is closed when Listen returns, after the queued packets have been handled
+	listenDone chan struct{}
 }
 
-func NewMasterServer(cfg config.Config) *MasterServer {
-	return &MasterServer{
-		cfg: cfg,
+// NewMasterServer creates a master server registering the game servers in the given store.
+// The store is closed by Shutdown.
+func NewMasterServer(cfg config.Config, store Store) (*MasterServer, error) {
+	challenger, err := newChallenger(cfg, store)
+	if err != nil {
+		return nil, err
+	}
+	handlersCtx, cancelHandlers := context.WithCancel(context.Background())
+	ms := &MasterServer{
+		cfg:            cfg,
+		store:          store,
+		challenger:     challenger,
+		limits:         newLimits(cfg),
+		handlersCtx:    handlersCtx,
+		cancelHandlers: cancelHandlers,
 	}
+	if cfg.VerifyServers {
+		ms.verifier = ms.newVerifier()
+	}
+	if cfg.BanThreshold > 0 {
+		ms.challengeFailures = newChallengeFailures(int(cfg.BanThreshold), time.Duration(cfg.BanWindow)*time.Second)
+	}
+	if cfg.Limits.ListHandshakeSize > 0 {
+		// its own secrets, so that a handshake challenge can't answer a join
+		ms.listHandshake, err = newHMACChallenger(time.Duration(cfg.ChallengeExpiration) * time.Second)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ms, nil
+}
+
+// heartbeatDeadline returns the date before which a game server is considered offline
+func (ms *MasterServer) heartbeatDeadline() time.Time {
+	return time.Now().Add(-time.Duration(ms.cfg.HeartbeatExpiration) * time.Second)
+}
+
+// challengeDeadline returns the date before which a challenge can't be answered anymore
+func (ms *MasterServer) challengeDeadline() time.Time {
+	return time.Now().Add(-time.Duration(ms.cfg.ChallengeExpiration) * time.Second)
+}
+
+// runReaper periodically removes the expired servers, challenges and bans from the store,
+// reloads the bans and forgets the idle rate limited sources and the stale heartbeat ports
+// until done is closed
+func (ms *MasterServer) runReaper(ctx context.Context, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(ms.cfg.ChallengeExpiration) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if err := ms.store.PurgeExpired(ctx, ms.heartbeatDeadline(), ms.challengeDeadline(), now); err != nil {
+				log.Println("[WARN] Unable to purge the expired entries: " + err.Error())
+			}
+			if err := ms.refreshBans(ctx); err != nil {
+				log.Println("[WARN] Unable to reload the bans: " + err.Error())
+			}
+			if ms.challengeFailures != nil {
+				ms.challengeFailures.purge(now)
+			}
+			ms.limits.purge(now)
+			ms.heartbeatPorts.purge(ms.heartbeatDeadline())
+		}
+	}
+}
+
+// serverListPageSize returns how many servers fit in one server list reply,
+// keeping room for the terminating null endpoint
+func (ms *MasterServer) serverListPageSize(entrySize int64) int64 {
+	packetSize := ms.cfg.MaxPacketSize
+	if packetSize == 0 {
+		packetSize = config.DefaultMaxPacketSize
+	}
+	count := (int64(packetSize) - int64(len(valve.ServerListHeader)) - entrySize) / entrySize
+	if ms.cfg.ServerListPageSize > 0 && int64(ms.cfg.ServerListPageSize) < count {
+		count = int64(ms.cfg.ServerListPageSize)
+	}
+	return count
 }
 
 type GameServer struct {
-	ID                primitive.ObjectID `bson:"_id,omitempty"`
-	EndpointID        int64              `bson:"endpointID,omitempty"`
-	IP                string             `bson:"ip,omitempty"`
-	Port              int32              `bson:"port,omitempty"`
-	LastHeartbeatDate time.Time          `bson:"lastHeartbeatDate,omitempty"`
+	ID                 primitive.ObjectID `bson:"_id,omitempty"`
+	EndpointKey        EndpointKey        `bson:"endpointKey,omitempty"`
+	IP                 string             `bson:"ip,omitempty"`
+	Port               int32              `bson:"port,omitempty"`
+	LastHeartbeatDate  time.Time          `bson:"lastHeartbeatDate,omitempty"`
+	FirstHeartbeatDate time.Time          `bson:"firstHeartbeatDate,omitempty"`
+	HeartbeatCount     int64              `bson:"heartbeatCount,omitempty"`
+	Protocol           int32              `bson:"protocol"`
+	Region             valve.Region       `bson:"region"`
+	Name               string             `bson:"name,omitempty"`
+	GameDir            string             `bson:"gameDir"`
+	Map                string             `bson:"map"`
+	Players            int32              `bson:"players"`
+	Max                int32              `bson:"max"`
+	Bots               int32              `bson:"bots"`
+	Type               string             `bson:"type"`
+	OS                 string             `bson:"os"`
+	Password           bool               `bson:"password"`
+	Lan                bool               `bson:"lan"`
+	Secure             bool               `bson:"secure"`
+	Version            string             `bson:"version"`
+	Product            string             `bson:"product"`
+	AppID              int32              `bson:"appID,omitempty"`
+	GameType           []string           `bson:"gameType,omitempty"`
+	GameData           []string           `bson:"gameData"`
+	// Dialect is the protocol flavour of the heartbeats, the Source servers also send
+	// the app ID and game type, and HeartbeatPort when they aren't sent from the game port
+	Dialect       valve.Dialect `bson:"dialect,omitempty"`
+	HeartbeatPort int32         `bson:"heartbeatPort,omitempty"`
+	// the name isn't in the heartbeats, it's only written by the A2S_INFO probes like
+	// the following fields, which also update the app ID and game type, see applyProbe
+	Visible       bool      `bson:"visible,omitempty"`
+	ProbeDate     time.Time `bson:"probeDate,omitempty"`
+	ProbeFailures int32     `bson:"probeFailures,omitempty"`
+}
+
+// NewGameServer creates a GameServer from the heartbeat sent by the given endpoint
+func NewGameServer(endpoint *ServerEndpoint, challengeReq *valve.ChallengeRequest) *GameServer {
+	return &GameServer{
+		EndpointKey:       endpoint.Key(),
+		IP:                endpoint.IP.String(),
+		Port:              int32(endpoint.Port),
+		LastHeartbeatDate: time.Now(),
+		Protocol:          challengeReq.Protocol,
+		Region:            challengeReq.Region,
+		GameDir:           challengeReq.GameDir,
+		Map:               challengeReq.Map,
+		Players:           challengeReq.Players,
+		Max:               challengeReq.Max,
+		Bots:              challengeReq.Bots,
+		Type:              challengeReq.Type,
+		OS:                string(challengeReq.OS),
+		Password:          challengeReq.Password,
+		Lan:               challengeReq.Lan,
+		Secure:            challengeReq.Secure,
+		Version:           challengeReq.Version,
+		Product:           challengeReq.Product,
+		AppID:             challengeReq.AppID,
+		GameType:          splitTags(challengeReq.GameType),
+		Dialect:           challengeReq.Dialect,
+	}
+}
+
+// splitTags splits the comma-separated tags of a game server, nil when there is none
+func splitTags(tags string) []string {
+	if len(tags) == 0 {
+		return nil
+	}
+	return strings.Split(tags, ",")
 }
 
 type Challenge struct {
-	ID         primitive.ObjectID `bson:"_id,omitempty"`
-	EndpointID int64              `bson:"endpointID,omitempty"`
-	Value      int32              `bson:"value,omitempty"`
-	UpdatedAt  time.Time          `bson:"updatedAt,omitempty"`
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	EndpointKey EndpointKey        `bson:"endpointKey,omitempty"`
+	Value       int32              `bson:"value,omitempty"`
+	UpdatedAt   time.Time          `bson:"updatedAt,omitempty"`
 }
 
 type ServerEndpoint struct {
@@ -68,342 +236,457 @@ func NewServerEndpoint(gameServer *GameServer) *ServerEndpoint {
 	}
 }
 
+// ParseServerEndpoint parses an IP:port string, like the seed of a server list query.
+// An empty string is parsed as the null endpoint.
+func ParseServerEndpoint(s string) (*ServerEndpoint, error) {
+	if len(s) == 0 {
+		return &ServerEndpoint{IP: nullEndpoint.IP, Port: nullEndpoint.Port}, nil
+	}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.New("The endpoint " + s + " has an invalid IP address")
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.New("The endpoint " + s + " has an invalid port")
+	}
+	return &ServerEndpoint{IP: ip, Port: uint16(p)}, nil
+}
+
 func (c *ServerEndpoint) String() string {
-	p := strconv.Itoa(int(c.Port))
-	return c.IP.String() + ":" + p
+	return net.JoinHostPort(c.IP.String(), strconv.Itoa(int(c.Port)))
 }
 
+// Bytes returns the legacy server list entry, an IPv6 address is written as 0.0.0.0
 func (c *ServerEndpoint) Bytes() []byte {
 
+	ip := c.IP.To4()
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
 	buffer := new(bytes.Buffer)
-	buffer.WriteByte(c.IP[0])
-	buffer.WriteByte(c.IP[1])
-	buffer.WriteByte(c.IP[2])
-	buffer.WriteByte(c.IP[3])
+	buffer.Write(ip)
 	binary.Write(buffer, binary.BigEndian, uint16(c.Port))
 
 	return buffer.Bytes()
 }
 
-func (c *ServerEndpoint) Uint64() uint64 {
-	arr := []byte{0x00, 0x00, byte(c.Port >> 8), byte(c.Port & 0xFF), c.IP[0], c.IP[1], c.IP[2], c.IP[0]}
-	ret := binary.BigEndian.Uint64(arr)
+// IPv6Bytes returns the IPv6 server list entry, an IPv4 address is mapped in IPv6
+func (c *ServerEndpoint) IPv6Bytes() []byte {
+	buffer := make([]byte, valve.ServerListIPv6EntrySize)
+	copy(buffer, c.IP.To16())
+	binary.BigEndian.PutUint16(buffer[net.IPv6len:], c.Port)
+	return buffer
+}
+
+// EndpointKey identifies an endpoint in the stores, the keys order is the endpoints order
+// (IP address then port). It's the hexadecimal form of the 16 bytes IP address, IPv4 ones
+// being mapped in IPv6, followed by the 2 bytes port, so it's the same for all stores.
+type EndpointKey string
+
+// ipv4KeyPrefix starts the keys of the IPv4 endpoints, it's the ::ffff:0:0/96 prefix
+const ipv4KeyPrefix = "00000000000000000000ffff"
+
+// Key returns the key identifying the endpoint in the stores
+func (c *ServerEndpoint) Key() EndpointKey {
+	return EndpointKey(hex.EncodeToString(c.IPv6Bytes()))
+}
+
+// endpointKeyIPLength is the length of the IP address part of a key
+const endpointKeyIPLength = 2 * net.IPv6len
 
-	// log.Println("The endpoint " + c.String() + " has a hash value equals to " + strconv.Itoa(int(ret)))
+// ipKey returns the IP address part of the key
+func (k EndpointKey) ipKey() string {
+	if len(k) < endpointKeyIPLength {
+		return string(k)
+	}
+	return string(k[:endpointKeyIPLength])
+}
 
-	return ret
+// lastOfIP returns the greatest key with the IP address of k, the keys after it have other addresses
+func (k EndpointKey) lastOfIP() EndpointKey {
+	if len(k) == 0 {
+		return k
+	}
+	return EndpointKey(k.ipKey() + "ffff")
 }
 
-func handleServerListRequest(buffer []byte, endpoint *ServerEndpoint) []byte {
-	response := new(bytes.Buffer)
-	response.Write(valve.ServerListHeader)
+// IsIPv4 checks if the key identifies an IPv4 endpoint
+func (k EndpointKey) IsIPv4() bool {
+	return strings.HasPrefix(string(k), ipv4KeyPrefix)
+}
 
-	opts := options.Find().SetSort(bson.D{{"endpointID", 1}}).SetLimit(config.ServerListMaxCount)
-	filter := bson.D{{"endpointID", bson.D{{"$gt", endpoint.Uint64()}}}}
-	cursor, err := gameServersCollection.Find(context.TODO(), filter, opts)
+// IsNull checks if the endpoint is the null one, used as the first seed and the last entry of the lists
+func (c *ServerEndpoint) IsNull() bool {
+	return c.Port == 0 && (c.IP == nil || c.IP.IsUnspecified())
+}
 
+func (ms *MasterServer) handleServerListRequest(ctx context.Context, buffer []byte, endpoint *ServerEndpoint) ([]byte, error) {
+	var listReq valve.ServerListRequest
+	if err := valve.UnmarshallServerListRequest(buffer, &listReq); err != nil {
+		return nil, malformed(err)
+	}
+	seed, err := ParseServerEndpoint(listReq.Seed)
 	if err != nil {
-		log.Fatal(err)
+		return nil, malformed(err)
+	}
+	after := seed.Key()
+	if seed.IsNull() {
+		after = ""
 	}
 
-	returnedServerCount := cursor.RemainingBatchLength()
+	// the legacy entries can't hold an IPv6 address, those servers are only
+	// listed to the clients asking for the IPv6 entries
+	ipv6Condition, ipv6 := listReq.Filter.Lookup(valve.FilterIPv6)
+	ipv6 = ipv6 && ipv6Condition.Bool()
+	entrySize := int64(valve.ServerListIPv4EntrySize)
+	if ipv6 {
+		entrySize = valve.ServerListIPv6EntrySize
+	}
 
-	for cursor.Next(context.TODO()) {
-		var gameServer GameServer
-		if err = cursor.Decode(&gameServer); err != nil {
-			log.Fatal(err)
-		}
-		endpoint := NewServerEndpoint(&gameServer)
-		response.Write(endpoint.Bytes())
+	pageSize := ms.serverListPageSize(entrySize)
+	// one more entry than a page is fetched to know if another page follows
+	query := &ServerQuery{
+		After:       after,
+		ActiveSince: ms.heartbeatDeadline(),
+		Region:      listReq.Region,
+		Filter:      listReq.Filter,
+		IPv4Only:    !ipv6,
+		VisibleOnly: ms.cfg.VerifyServers,
+		Limit:       pageSize + 1,
+	}
+	// the collapse is done by the store, so that an address isn't listed again on the next pages
+	if collapse, found := listReq.Filter.Lookup(valve.FilterCollapseAddrHash); found {
+		query.CollapseAddr = collapse.Bool()
+	}
+	gameServers, err := ms.store.FindServers(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	// the null endpoint ending the last page tells the client there is no more page to request
+	reply := &valve.ServerListReply{
+		Servers: make([]valve.ServerAddress, 0, len(gameServers)),
+		IPv6:    ipv6,
+		Last:    int64(len(gameServers)) <= pageSize,
+	}
+	if !reply.Last {
+		gameServers = gameServers[:pageSize]
 	}
 
-	if returnedServerCount < int(config.ServerListMaxCount) {
-		response.Write(nullEndpoint.Bytes())
+	for i := range gameServers {
+		gameServer := &gameServers[i]
+		reply.Servers = append(reply.Servers, valve.ServerAddress{
+			IP:   net.ParseIP(gameServer.IP),
+			Port: uint16(gameServer.Port),
+		})
 	}
 
-	return response.Bytes()
+	response := valve.MarshallServerListReply(reply)
+	if ms.listHandshake != nil && len(response) > int(ms.cfg.Limits.ListHandshakeSize) {
+		// the header byte isn't in the buffer
+		return ms.checkListHandshake(ctx, &listReq, len(buffer)+1, endpoint, response)
+	}
+	return response, nil
 }
 
-func handleJoinRequest(endpoint *ServerEndpoint) []byte {
-	response := new(bytes.Buffer)
-	response.Write(valve.ChallengeHeader)
-	challengeNumber := int32(rand.Int())
-	binary.Write(response, binary.BigEndian, challengeNumber)
-	opts := options.Update().SetUpsert(true) // create a new document if not already here
-	filter := bson.D{{"endpointID", endpoint.Uint64()}}
-	update := bson.D{{"$set", bson.D{{"value", challengeNumber}, {"updatedAt", time.Now()}}}}
-	res, err := challengesCollection.UpdateOne(context.TODO(), filter, update, opts)
+// listHandshakeReplySize is the size of the handshake challenge sent instead of a large server list
+var listHandshakeReplySize = len(valve.ChallengeHeader) + 4
+
+// checkListHandshake returns the large server list reply if the request answers a handshake
+// challenge, or a new challenge otherwise. The requests smaller than the challenge reply are
+// dropped, so a spoofed request can't make the master server send more than it received.
+func (ms *MasterServer) checkListHandshake(ctx context.Context, listReq *valve.ServerListRequest, requestSize int, endpoint *ServerEndpoint, reply []byte) ([]byte, error) {
+	if requestSize < listHandshakeReplySize {
+		return nil, malformed(errors.New("The server list request is smaller than the handshake challenge"))
+	}
+	if listReq.Challenge != nil {
+		err := ms.listHandshake.Verify(ctx, endpoint, *listReq.Challenge)
+		if err == nil {
+			return reply, nil
+		}
+		if !errors.Is(err, ErrWrongChallenge) {
+			return nil, err
+		}
+		// an expired challenge is answered with a new one like a missing one
+	}
+	challengeNumber, err := ms.listHandshake.Issue(ctx, endpoint)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	if res.UpsertedCount == 0 {
-		log.Println("[INFO] JOIN - An endpoint has been updated in the challenge database (" + endpoint.String() + ")")
-	} else {
-		log.Println("[INFO] JOIN - A new endpoint has been added in the challenge database (" + endpoint.String() + ")")
+	atomic.AddUint64(&ms.stats.Handshakes, 1)
+	return valve.MarshallJoinReply(challengeNumber), nil
+}
+
+func (ms *MasterServer) handleJoinRequest(ctx context.Context, endpoint *ServerEndpoint) ([]byte, error) {
+	challengeNumber, err := ms.challenger.Issue(ctx, endpoint)
+	if err != nil {
+		return nil, err
 	}
-	return response.Bytes()
+	log.Println("[INFO] JOIN - A challenge has been issued (" + endpoint.String() + ")")
+	return valve.MarshallJoinReply(challengeNumber), nil
 }
 
-func handleQuitRequest(endpoint *ServerEndpoint) {
-	res, err := gameServersCollection.DeleteOne(context.TODO(), bson.D{{"endpointID", endpoint.Uint64()}})
+func (ms *MasterServer) handleQuitRequest(ctx context.Context, endpoint *ServerEndpoint) error {
+	// a Source server quits from the port its heartbeats are sent from
+	if listed := ms.heartbeatPorts.take(endpoint); listed != nil {
+		endpoint = listed
+	}
+	removed, err := ms.store.RemoveServer(ctx, endpoint)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	if res.DeletedCount == 0 {
-		log.Println("[WARN] QUIT - Received a request for an unknown endpoint (" + endpoint.String() + ")")
-	} else {
+	if removed {
 		log.Println("[INFO] QUIT - An endpoint has been removed from the database (" + endpoint.String() + ")")
+	} else {
+		log.Println("[WARN] QUIT - Received a request for an unknown endpoint (" + endpoint.String() + ")")
 	}
+	return nil
 }
 
-func handleChallengeRequest(req []byte, endpoint *ServerEndpoint) {
+func (ms *MasterServer) handleChallengeRequest(ctx context.Context, req []byte, endpoint *ServerEndpoint) error {
+	// both dialects are accepted, the Source servers are told apart by their keys
 	var challengeReq valve.ChallengeRequest
-	err := valve.UnmarshallChallenge(req, &challengeReq)
+	err := valve.UnmarshallHeartbeat(req, &challengeReq)
 	if err != nil {
-		log.Fatal(err)
+		return malformed(err)
+	}
+	if !challengeReq.Region.IsValid() {
+		log.Println("[WARN] CHALLENGE - Received an unknown region code, the endpoint will be listed in all regions (" + endpoint.String() + ")")
+		challengeReq.Region = valve.AllRegions
 	}
-	filter := bson.D{{"endpointID", endpoint.Uint64()}}
-	var challengeEntry Challenge
-	err = challengesCollection.FindOne(context.TODO(), filter).Decode(&challengeEntry)
+	err = ms.challenger.Verify(ctx, endpoint, challengeReq.ChallengeValue)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			// ? (jbltx) blacklist endpoint ?
-			return
+		if errors.Is(err, ErrUnknownChallenge) || errors.Is(err, ErrWrongChallenge) {
+			ms.recordChallengeFailure(ctx, endpoint)
 		}
-		log.Fatal(err)
+		return err
 	}
-	challengesCollection.DeleteOne(context.TODO(), filter)
-	if challengeEntry.Value != challengeReq.ChallengeValue {
-		// ? (jbltx) blacklist endpoint ?
-	} else {
-		// todo (jbltx) For now we don't use challenge infos,
-		// todo (jbltx) maybe store them in database ?
-		gameServer := GameServer{
-			EndpointID:        int64(endpoint.Uint64()),
-			IP:                endpoint.IP.String(),
-			Port:              int32(endpoint.Port),
-			LastHeartbeatDate: time.Now(),
-		}
-		opts := options.Update().SetUpsert(true) // create a new document if not already here
-		update := bson.D{{Key: "$set", Value: gameServer}}
-		res, err := gameServersCollection.UpdateOne(context.TODO(), filter, update, opts)
-		if err != nil {
-			log.Fatal(err)
+
+	// a Source server may send its heartbeats from another port than its game port,
+	// it's listed and probed on its game port
+	var heartbeatPort int32
+	if challengeReq.GamePort != 0 && challengeReq.GamePort != endpoint.Port {
+		listed := &ServerEndpoint{IP: endpoint.IP, Port: challengeReq.GamePort}
+		if ms.bans.isBanned(listed, time.Now()) {
+			atomic.AddUint64(&ms.stats.Banned, 1)
+			return nil
 		}
-		if res.UpsertedCount == 0 {
-			log.Println("[INFO] CHALLENGE - An endpoint has been updated in the database (" + endpoint.String() + ")")
-		} else {
-			log.Println("[INFO] CHALLENGE - A new endpoint has been added in the database (" + endpoint.String() + ")")
+		ms.heartbeatPorts.set(endpoint, listed, time.Now())
+		heartbeatPort = int32(endpoint.Port)
+		endpoint = listed
+	}
+
+	gameServer := NewGameServer(endpoint, &challengeReq)
+	gameServer.HeartbeatPort = heartbeatPort
+	created, err := ms.store.SaveServer(ctx, gameServer)
+	if err != nil {
+		return err
+	}
+	if created {
+		log.Println("[INFO] CHALLENGE - A new endpoint has been added in the database (" + endpoint.String() + ")")
+		if ms.verifier != nil {
+			ms.verifier.enqueue(endpoint)
 		}
+	} else {
+		log.Println("[INFO] CHALLENGE - An endpoint has been updated in the database (" + endpoint.String() + ")")
 	}
+	return nil
 }
 
-// func setupDatabase(db *mongo.Database) {
-
-// 	collectionNames, colErr := db.ListCollectionNames(context.TODO(), bson.D{})
-// 	if colErr != nil {
-// 		log.Fatal(colErr)
-// 	}
-
-// 	for _, col := range collectionNames {
-// 		if dropErr := db.Collection(col).Drop(context.TODO()); dropErr != nil {
-// 			log.Fatal(dropErr)
-// 		}
-// 	}
-
-// 	serversCollectionSchema := bson.M{
-// 		"bsonType": "object",
-// 		"required": []string{"endpointID", "ip", "port", "lastHeartbeatDate"},
-// 		"properties": bson.M{
-// 			"endpointID": bson.M{
-// 				"bsonType":    "long",
-// 				"description": "the endpoint Hash",
-// 			},
-// 			"ip": bson.M{
-// 				"bsonType":    "string",
-// 				"description": "the endpoint IP address",
-// 			},
-// 			"port": bson.M{
-// 				"bsonType":    "int",
-// 				"maximum":     65535,
-// 				"description": "the endpoint Port",
-// 			},
-// 			"lastHeartbeatDate": bson.M{
-// 				"bsonType":    "date",
-// 				"description": "the last time when the heartbeat has been received",
-// 			},
-// 		},
-// 	}
-// 	serversCollectionValidator := bson.M{
-// 		"$jsonSchema": serversCollectionSchema,
-// 	}
-// 	serversCollectionOpts := options.CreateCollection().SetValidator(serversCollectionValidator)
-// 	err := db.CreateCollection(context.TODO(), serversCollectionName, serversCollectionOpts)
-// 	if err != nil {
-// 		log.Fatal(err)
-// 	}
-// 	serversCollectionIndices := []mongo.IndexModel{
-// 		{
-// 			Keys:    bson.D{{"endpointID", 1}},
-// 			Options: options.Index().SetUnique(true),
-// 		},
-// 		{
-// 			Keys:    bson.D{{"lastHeartbeatDate", 1}},
-// 			Options: options.Index().SetExpireAfterSeconds(serverEntryExpiration),
-// 		},
-// 	}
-// 	opts := options.CreateIndexes().SetMaxTime(2 * time.Second)
-// 	db.Collection(serversCollectionName).Indexes().CreateMany(context.TODO(), serversCollectionIndices, opts)
-
-// 	challengesCollectionSchema := bson.M{
-// 		"bsonType": "object",
-// 		"required": []string{"endpointID", "value"},
-// 		"properties": bson.M{
-// 			"endpointID": bson.M{
-// 				"bsonType":    "long",
-// 				"description": "the endpoint Hash",
-// 			},
-// 			"value": bson.M{
-// 				"bsonType":    "int",
-// 				"description": "the challenged requested to the gameserver",
-// 			},
-// 			"updatedAt": bson.M{
-// 				"bsonType":    "date",
-// 				"description": "last update date",
-// 			},
-// 		},
-// 	}
-// 	challengesCollectionValidator := bson.M{
-// 		"$jsonSchema": challengesCollectionSchema,
-// 	}
-// 	challengesCollectionOpts := options.CreateCollection().SetValidator(challengesCollectionValidator)
-// 	err = db.CreateCollection(context.TODO(), challengesCollectionName, challengesCollectionOpts)
-// 	if err != nil {
-// 		log.Fatal(err)
-// 	}
-// 	challengesCollectionIndices := []mongo.IndexModel{
-// 		{
-// 			Keys:    bson.D{{"endpointID", 1}},
-// 			Options: options.Index().SetUnique(true),
-// 		},
-// 		{
-// 			Keys:    bson.D{{"updatedAt", 1}},
-// 			Options: options.Index().SetExpireAfterSeconds(challengeEntryExpiration),
-// 		},
-// 	}
-// 	db.Collection(challengesCollectionName).Indexes().CreateMany(context.TODO(), challengesCollectionIndices, opts)
-// }
-
-// func populateDatabase() {
-
-// 	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
-
-// 	gs := GameServer{
-// 		EndpointID:        123456789,
-// 		IP:                "192.168.2.16",
-// 		Port:              27015,
-// 		LastHeartbeatDate: time.Now(),
-// 	}
-
-// 	res, err := gameServersCollection.InsertOne(ctx, gs)
-
-// 	if err != nil {
-// 		log.Fatal(err)
-// 	}
-
-// 	log.Println(res.InsertedID.(primitive.ObjectID).Hex())
-
-// 	ch := Challenge{
-// 		EndpointID: 123456789,
-// 		Value:      123,
-// 		UpdatedAt:  time.Now(),
-// 	}
-
-// 	res, err = challengesCollection.InsertOne(ctx, ch)
-
-// 	log.Println(res.InsertedID.(primitive.ObjectID).Hex())
-// }
-
-func (ms *MasterServer) Listen() error {
-
-	mongoClient, err := mongo.NewClient(options.Client().ApplyURI(ms.cfg.Database.URL))
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	err = mongoClient.Connect(ctx)
+// handlePacket dispatches a received packet to its handler and returns the reply to send, if any.
+// The returned error is a *RequestError, a panic while handling the packet is recovered as one.
+func (ms *MasterServer) handlePacket(ctx context.Context, packet []byte, endpoint *ServerEndpoint) (response []byte, err error) {
+	request := unknownRequest
 	defer func() {
-		if err = mongoClient.Disconnect(ctx); err != nil {
-			panic(err)
+		if r := recover(); r != nil {
+			response = nil
+			err = newRequestError(request, endpoint, fmt.Errorf("%w: %v", ErrMalformedRequest, r))
 		}
 	}()
 
-	db := mongoClient.Database(ms.cfg.Database.Name)
+	if len(packet) == 0 || len(packet) > maxRequestSize {
+		return nil, newRequestError(request, endpoint, ErrMalformedRequest)
+	}
+	// a banned endpoint gets no reply at all, so it can't tell why
+	if ms.bans.isBanned(endpoint, time.Now()) {
+		atomic.AddUint64(&ms.stats.Banned, 1)
+		return nil, nil
+	}
 
-	// // ! Start DEBUG
-	// args := os.Args
-	// if len(args) > 1 && args[1] == "setup" {
-	// 	setupDatabase(db)
-	// 	return
-	// }
-	// // ! End DEBUG
+	switch packet[0] {
+	case valve.RequestServerListHeader:
+		request = listRequest
+		response, err = ms.handleServerListRequest(ctx, packet[1:], endpoint)
+	case valve.RequestJoinHeader:
+		request = joinRequest
+		if err = valve.UnmarshallJoinRequest(packet[1:]); err != nil {
+			err = malformed(err)
+			break
+		}
+		response, err = ms.handleJoinRequest(ctx, endpoint)
+	case valve.RequestQuitHeader:
+		request = quitRequest
+		if err = valve.UnmarshallQuitRequest(packet[1:]); err != nil {
+			err = malformed(err)
+			break
+		}
+		err = ms.handleQuitRequest(ctx, endpoint)
+	case valve.RequestChallengeHeader:
+		request = challengeRequest
+		err = ms.handleChallengeRequest(ctx, packet[1:], endpoint)
+	default:
+		err = malformed(fmt.Errorf("The header 0x%02x is unknown", packet[0]))
+	}
 
-	gameServersCollection = db.Collection(config.ServersCollectionName)
-	challengesCollection = db.Collection(config.ChallengesCollectionName)
+	if err != nil {
+		return nil, newRequestError(request, endpoint, err)
+	}
+	return response, nil
+}
 
-	// // ! Start DEBUG
-	// if len(args) > 1 && args[1] == "populate" {
-	// 	populateDatabase()
-	// 	return
-	// }
-	// // ! End DEBUG
+// Listen receives and handles the packets until the context is canceled or Shutdown is called.
+// The packets already queued are handled before it returns.
+func (ms *MasterServer) Listen(ctx context.Context) error {
 
-	s, err := net.ResolveUDPAddr("udp4", ":"+strconv.Itoa(int(ms.cfg.Port)))
+	// the dual-stack socket receives both the IPv4 and the IPv6 packets
+	s, err := net.ResolveUDPAddr("udp", ":"+strconv.Itoa(int(ms.cfg.Port)))
 	if err != nil {
 		return err
 	}
 
-	connection, err := net.ListenUDP("udp4", s)
+	connection, err := net.ListenUDP("udp", s)
 	if err != nil {
 		return err
 	}
 
+	ms.mu.Lock()
+	if ms.closing || ms.listenDone != nil {
+		ms.mu.Unlock()
+		connection.Close()
+		return ErrServerClosed
+	}
+	ms.connection = connection
+	ms.listenDone = make(chan struct{})
+	ms.mu.Unlock()
+	defer close(ms.listenDone)
+	// closed after the workers are done, they still reply to the queued packets
 	defer connection.Close()
-	buffer := make([]byte, 1600) // standard MTU size -- no packet should be bigger
+
+	listenCtx, stopListening := context.WithCancel(ctx)
+	defer stopListening()
+	go func() {
+		<-listenCtx.Done()
+		ms.stopReading()
+	}()
+
+	// the background tasks are stopped after the queued packets have been handled,
+	// and they are waited for since they use the store
+	backgroundDone := make(chan struct{})
+	var background sync.WaitGroup
+	defer func() {
+		close(backgroundDone)
+		background.Wait()
+	}()
+	if err := ms.refreshBans(ms.handlersCtx); err != nil {
+		log.Println("[WARN] Unable to load the bans: " + err.Error())
+	}
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		ms.runReaper(ms.handlersCtx, backgroundDone)
+	}()
+	if ms.verifier != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			ms.verifier.run(ms.handlersCtx, backgroundDone)
+		}()
+	}
+
+	pool := ms.newWorkerPool(connection)
+	defer pool.close()
+
+	// one byte more than the biggest request, so that the truncated datagrams are noticed
+	buffer := make([]byte, maxRequestSize+1)
 	rand.Seed(time.Now().Unix())
 
 	for {
 		n, addr, err := connection.ReadFromUDP(buffer)
 
 		if err != nil {
+			if ms.isClosing() {
+				return nil
+			}
 			fmt.Println(err)
 			continue
 		}
-
-		endpoint := &ServerEndpoint{
-			IP:   addr.IP,
-			Port: uint16(addr.Port),
+		atomic.AddUint64(&ms.stats.Received, 1)
+		if n > maxRequestSize {
+			atomic.AddUint64(&ms.stats.Malformed, 1)
+			continue
 		}
-
-		reqHeader := buffer[0]
-		var response []byte = nil
-		switch reqHeader {
-		case valve.RequestServerListHeader:
-			response = handleServerListRequest(buffer[1:n-2], endpoint)
-		case valve.RequestJoinHeader:
-			response = handleJoinRequest(endpoint)
-		case valve.RequestQuitHeader:
-			if bytes.Equal(buffer, valve.QuitHeader) {
-				handleQuitRequest(endpoint)
-			}
-		case valve.RequestChallengeHeader:
-			handleChallengeRequest(buffer[1:n-2], endpoint)
-		default:
+		// the limits are checked before queuing, a flood can't delay the other packets
+		if n > 0 && !ms.limits.allowPacket(buffer[0], addr.IP, time.Now()) {
+			atomic.AddUint64(&ms.stats.RateLimited, 1)
 			continue
 		}
 
-		if response != nil {
-			_, err = connection.WriteToUDP(response, addr)
+		// the read buffer is reused, the queued packet needs its own copy
+		packet := make([]byte, n)
+		copy(packet, buffer[:n])
+		pool.dispatch(packet, addr)
+	}
+}
+
+// stopReading stops the packets reception, the connection stays open for the pending replies
+func (ms *MasterServer) stopReading() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.closing {
+		return
+	}
+	ms.closing = true
+	if ms.connection != nil {
+		// unblocks the pending read
+		ms.connection.SetReadDeadline(time.Now())
+	}
+}
+
+func (ms *MasterServer) isClosing() bool {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return ms.closing
+}
+
+// Shutdown stops the packets reception, waits for the queued packets to be handled
+// and closes the store. If the context expires first, the pending store operations
+// are canceled and the context error is returned.
+func (ms *MasterServer) Shutdown(ctx context.Context) error {
+	ms.stopReading()
+
+	ms.mu.Lock()
+	listenDone := ms.listenDone
+	ms.mu.Unlock()
+
+	var err error
+	if listenDone != nil {
+		select {
+		case <-listenDone:
+		case <-ctx.Done():
+			err = ctx.Err()
+			ms.cancelHandlers()
+			<-listenDone
 		}
 	}
+	ms.cancelHandlers()
 
-	return nil
+	if closeErr := ms.store.Close(ctx); err == nil {
+		err = closeErr
+	}
+	return err
 }
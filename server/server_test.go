@@ -0,0 +1,428 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jbltx/master-server/config"
+	"github.com/jbltx/master-server/valve"
+)
+
+// newTestMasterServer creates a master server keeping its game servers in memory,
+// the game servers aren't probed
+func newTestMasterServer(t *testing.T) *MasterServer {
+	t.Helper()
+	return newTestMasterServerWith(t, newMemoryStore(), nil)
+}
+
+// newTestMasterServerWith creates a master server using the store, the game servers aren't probed
+// unless configure, which can be nil, changes the configuration
+func newTestMasterServerWith(t *testing.T, store Store, configure func(cfg *config.Config)) *MasterServer {
+	t.Helper()
+	cfg := config.NewDefaultConfig()
+	cfg.Database.Driver = config.MemoryDriver
+	cfg.VerifyServers = false
+	if configure != nil {
+		configure(&cfg)
+	}
+	ms, err := NewMasterServer(cfg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ms.store.Close(context.Background()) })
+	return ms
+}
+
+func testEndpoint(t *testing.T, s string) *ServerEndpoint {
+	t.Helper()
+	endpoint, err := ParseServerEndpoint(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return endpoint
+}
+
+// saveTestServer registers a game server located in the region, as a heartbeat would
+func saveTestServer(t *testing.T, ms *MasterServer, endpoint *ServerEndpoint, region valve.Region) {
+	t.Helper()
+	gameServer := NewGameServer(endpoint, &valve.ChallengeRequest{
+		Protocol: 48,
+		GameDir:  "cstrike",
+		Map:      "de_dust2",
+		Max:      16,
+		OS:       valve.OperatingSystem(valve.Linux),
+		Region:   region,
+		Type:     valve.Dedicated,
+		Version:  "1.1.2.7",
+		Product:  "cstrike",
+	})
+	if _, err := ms.store.SaveServer(context.Background(), gameServer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// listTestServers sends a server list request for the region and the filter string,
+// and returns the listed endpoints of its single page
+func listTestServers(t *testing.T, ms *MasterServer, region valve.Region, filter string) []string {
+	t.Helper()
+	parsed, err := valve.ParseFilter(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := valve.MarshallServerListRequest(&valve.ServerListRequest{Region: region, Seed: valve.NullSeed, Filter: parsed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := ms.handlePacket(context.Background(), packet, testEndpoint(t, "198.51.100.1:50000"))
+	if err != nil {
+		t.Fatalf("handlePacket(list) = %v", err)
+	}
+	var reply valve.ServerListReply
+	if err := valve.UnmarshallServerListReply(response[len(valve.ServerListHeader):], false, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Last {
+		t.Fatal("The server list reply should be a single page")
+	}
+	servers := make([]string, 0, len(reply.Servers))
+	for _, server := range reply.Servers {
+		servers = append(servers, server.String())
+	}
+	return servers
+}
+
+func TestServerListRegions(t *testing.T) {
+	ms := newTestMasterServer(t)
+	regions := []valve.Region{
+		valve.USEastCoast, valve.USWestCoast, valve.SouthAmerica, valve.Europe,
+		valve.Asia, valve.Australia, valve.MiddleEast, valve.Africa,
+	}
+	// one game server in each region, its port tells its region
+	for _, region := range regions {
+		saveTestServer(t, ms, testEndpoint(t, "192.0.2.1:"+strconv.Itoa(27000+int(region))), region)
+	}
+	saveTestServer(t, ms, testEndpoint(t, "192.0.2.1:27255"), valve.AllRegions)
+
+	for _, region := range regions {
+		t.Run(region.String(), func(t *testing.T) {
+			got := listTestServers(t, ms, region, "")
+			want := []string{"192.0.2.1:" + strconv.Itoa(27000+int(region)), "192.0.2.1:27255"}
+			if !equalEndpoints(got, want) {
+				t.Errorf("servers of the region 0x%02X = %v, want %v", uint8(region), got, want)
+			}
+		})
+	}
+	t.Run(valve.AllRegions.String(), func(t *testing.T) {
+		if got := listTestServers(t, ms, valve.AllRegions, ""); len(got) != len(regions)+1 {
+			t.Errorf("servers of all regions = %v, want %d servers", got, len(regions)+1)
+		}
+	})
+}
+
+func equalEndpoints(got []string, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	seen := make(map[string]bool, len(got))
+	for _, endpoint := range got {
+		seen[endpoint] = true
+	}
+	for _, endpoint := range want {
+		if !seen[endpoint] {
+			return false
+		}
+	}
+	return true
+}
+
+// garbagePackets are all malformed, each of them is rate limited under the default burst of its header
+var garbagePackets = []struct {
+	name   string
+	packet []byte
+}{
+	{"empty", []byte{}},
+	{"list header only", []byte{valve.RequestServerListHeader}},
+	{"unknown header", []byte{0x00}},
+	{"unknown text header", []byte("hello")},
+	{"list with an unknown region", []byte("1\x080.0.0.0:0\x00\x00")},
+	{"list with an invalid seed", []byte("1\xffnot an endpoint\x00\x00")},
+	{"list with a truncated challenge", []byte("1\xff0.0.0.0:0\x00\x00\x01\x02")},
+	{"join with a body", []byte("q\x00")},
+	{"truncated quit", []byte("b\n")},
+	{"truncated heartbeat", []byte("0\n\\protocol\\48\\challenge")},
+	{"heartbeat without fields", []byte("0\n")},
+	{"oversized heartbeat", append([]byte("0\n\\protocol\\"), make([]byte, maxRequestSize)...)},
+}
+
+func TestHandlePacketGarbage(t *testing.T) {
+	ms := newTestMasterServer(t)
+	ctx := context.Background()
+	endpoint := testEndpoint(t, "192.0.2.1:27015")
+
+	for _, tt := range garbagePackets {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := ms.handlePacket(ctx, tt.packet, endpoint)
+			if response != nil {
+				t.Errorf("handlePacket() response = %q, want none", response)
+			}
+			if _, ok := err.(*RequestError); !ok || !errors.Is(err, ErrMalformedRequest) {
+				t.Errorf("handlePacket() error = %v, want a malformed request error", err)
+			}
+		})
+	}
+
+	response, err := ms.handlePacket(ctx, valve.MarshallJoinRequest(), endpoint)
+	if err != nil || !bytes.HasPrefix(response, valve.ChallengeHeader) {
+		t.Fatalf("handlePacket(join) = %q, %v, want a challenge", response, err)
+	}
+}
+
+// freeUDPPort returns a port the master server can listen on
+func freeUDPPort(t *testing.T) uint16 {
+	t.Helper()
+	connection, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	return uint16(connection.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// listenTestMasterServer runs the master server on a local port, it's shut down by the test cleanup
+func listenTestMasterServer(t *testing.T, ms *MasterServer) *net.UDPAddr {
+	t.Helper()
+	ms.cfg.Port = freeUDPPort(t)
+	done := make(chan error, 1)
+	go func() { done <- ms.Listen(context.Background()) }()
+	t.Cleanup(func() {
+		ms.Shutdown(context.Background())
+		if err := <-done; err != nil {
+			t.Errorf("Listen() = %v", err)
+		}
+	})
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: int(ms.cfg.Port)}
+}
+
+// exchangeTestPacket sends the packet until a reply arrives
+func exchangeTestPacket(t *testing.T, connection *net.UDPConn, packet []byte) []byte {
+	t.Helper()
+	buffer := make([]byte, maxRequestSize)
+	for attempt := 0; attempt < 20; attempt++ {
+		if _, err := connection.Write(packet); err != nil {
+			t.Fatal(err)
+		}
+		deadline := time.Now().Add(100 * time.Millisecond)
+		connection.SetReadDeadline(deadline)
+		if n, err := connection.Read(buffer); err == nil {
+			return buffer[:n]
+		}
+		// the read fails at once while the port is refused
+		time.Sleep(time.Until(deadline))
+	}
+	t.Fatalf("No reply to %q", packet)
+	return nil
+}
+
+func TestListenKeepsServingAfterGarbage(t *testing.T) {
+	ms := newTestMasterServer(t)
+	addr := listenTestMasterServer(t, ms)
+	connection, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+
+	// the join reply tells the master server is listening
+	if reply := exchangeTestPacket(t, connection, valve.MarshallJoinRequest()); !bytes.HasPrefix(reply, valve.ChallengeHeader) {
+		t.Fatalf("join reply = %q, want a challenge", reply)
+	}
+	for _, tt := range garbagePackets {
+		if _, err := connection.Write(tt.packet); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reply := exchangeTestPacket(t, connection, valve.MarshallJoinRequest()); !bytes.HasPrefix(reply, valve.ChallengeHeader) {
+		t.Fatalf("join reply after the garbage = %q, want a challenge", reply)
+	}
+
+	// the workers may still be handling the last garbage packets
+	deadline := time.Now().Add(2 * time.Second)
+	for ms.Stats().Malformed < uint64(len(garbagePackets)) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats := ms.Stats(); stats.Malformed != uint64(len(garbagePackets)) {
+		t.Errorf("Stats().Malformed = %d, want %d (%+v)", stats.Malformed, len(garbagePackets), stats)
+	}
+}
+
+// listTestServerPages requests every page of the server list for the region and the filter string,
+// and returns the listed endpoints
+func listTestServerPages(t *testing.T, ms *MasterServer, region valve.Region, filter string) []string {
+	t.Helper()
+	parsed, err := valve.ParseFilter(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipv6Condition, ipv6 := parsed.Lookup(valve.FilterIPv6)
+	ipv6 = ipv6 && ipv6Condition.Bool()
+	request := &valve.ServerListRequest{Region: region, Seed: valve.NullSeed, Filter: parsed}
+	servers := []string{}
+	for page := 0; ; page++ {
+		if page > 100 {
+			t.Fatalf("The server list has too many pages: %v", servers)
+		}
+		packet, err := valve.MarshallServerListRequest(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := ms.handlePacket(context.Background(), packet, testEndpoint(t, "198.51.100.1:50000"))
+		if err != nil {
+			t.Fatalf("handlePacket(list) = %v", err)
+		}
+		if packetSize := ms.cfg.MaxPacketSize; packetSize > 0 && len(response) > int(packetSize) {
+			t.Errorf("The page %d is %d bytes, more than %d", page, len(response), packetSize)
+		}
+		var reply valve.ServerListReply
+		if err := valve.UnmarshallServerListReply(response[len(valve.ServerListHeader):], ipv6, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Servers) == 0 && !reply.Last {
+			t.Fatalf("The page %d has neither a server nor the terminator", page)
+		}
+		for _, server := range reply.Servers {
+			servers = append(servers, server.String())
+		}
+		if reply.Last {
+			return servers
+		}
+		request.Seed = reply.Servers[len(reply.Servers)-1].String()
+	}
+}
+
+func TestServerListCollapseAddrHashPages(t *testing.T) {
+	ms := newTestMasterServer(t)
+	// 5 entries per page
+	ms.cfg.MaxPacketSize = config.MinMaxPacketSize
+	for port := 27000; port < 27020; port++ {
+		saveTestServer(t, ms, testEndpoint(t, "192.0.2.1:"+strconv.Itoa(port)), valve.Europe)
+	}
+	saveTestServer(t, ms, testEndpoint(t, "192.0.2.2:27015"), valve.Europe)
+	saveTestServer(t, ms, testEndpoint(t, "192.0.2.2:27016"), valve.Europe)
+	for port := 27000; port < 27007; port++ {
+		saveTestServer(t, ms, testEndpoint(t, "192.0.2.3:"+strconv.Itoa(port)), valve.Europe)
+	}
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"\\collapse_addr_hash\\1", []string{"192.0.2.1:27000", "192.0.2.2:27015", "192.0.2.3:27000"}},
+		// the first server of an address matching the other conditions is kept
+		{"\\collapse_addr_hash\\1\\gameaddr\\192.0.2.2", []string{"192.0.2.2:27015"}},
+		{"\\collapse_addr_hash\\1\\nand\\1\\gameaddr\\192.0.2.1:27000", []string{"192.0.2.1:27001", "192.0.2.2:27015", "192.0.2.3:27000"}},
+		{"\\collapse_addr_hash\\1\\ipv6\\1", []string{"192.0.2.1:27000", "192.0.2.2:27015", "192.0.2.3:27000"}},
+	}
+	for _, tt := range tests {
+		got := listTestServerPages(t, ms, valve.Europe, tt.filter)
+		if len(got) != len(tt.want) || !equalEndpoints(got, tt.want) {
+			t.Errorf("servers for %q = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+	for _, filter := range []string{"", "\\collapse_addr_hash\\0"} {
+		if got := listTestServerPages(t, ms, valve.Europe, filter); len(got) != 29 {
+			t.Errorf("servers for %q = %d servers, want 29", filter, len(got))
+		}
+	}
+}
+
+func TestServerListIPv6PagesAtMinPacketSize(t *testing.T) {
+	ms := newTestMasterServer(t)
+	ms.cfg.MaxPacketSize = config.MinMaxPacketSize
+	saveTestServer(t, ms, testEndpoint(t, "192.0.2.1:27015"), valve.Europe)
+	saveTestServer(t, ms, testEndpoint(t, "[2001:db8::1]:27015"), valve.Europe)
+
+	servers := listTestServerPages(t, ms, valve.Europe, "\\ipv6\\1")
+	if want := []string{"192.0.2.1:27015", "[2001:db8::1]:27015"}; len(servers) != len(want) || !equalEndpoints(servers, want) {
+		t.Errorf("servers = %v, want %v", servers, want)
+	}
+}
+
+func TestShutdownDrainsBeforeClosingStore(t *testing.T) {
+	store := newBlockingStore()
+	store.blockFind = true
+	store.blockPurge = true
+	// the reaper runs every second
+	ms := newTestMasterServerWith(t, store, func(cfg *config.Config) { cfg.ChallengeExpiration = 1 })
+	addr := listenTestMasterServer(t, ms)
+
+	connection, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	list, err := valve.MarshallServerListRequest(&valve.ServerListRequest{Region: valve.AllRegions, Seed: valve.NullSeed})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a list request and the reaper are both running when the server is shut down
+	exchangeTestPacket(t, connection, valve.MarshallJoinRequest())
+	if _, err := connection.Write(list); err != nil {
+		t.Fatal(err)
+	}
+	store.waitEntered(t, "FindServers")
+	store.waitEntered(t, "PurgeExpired")
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- ms.Shutdown(context.Background()) }()
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown() = %v before the work is done", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, closed := store.state(); closed {
+		t.Fatal("The store has been closed before the work is done")
+	}
+
+	close(store.release)
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatalf("Shutdown() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown() hasn't returned")
+	}
+
+	// the in-flight request has been answered before the socket was closed
+	buffer := make([]byte, maxRequestSize)
+	connection.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := connection.Read(buffer)
+	if err != nil {
+		t.Fatalf("The in-flight request hasn't been answered: %v", err)
+	}
+	if reply := buffer[:n]; len(reply) < len(valve.ServerListHeader) || string(reply[:len(valve.ServerListHeader)]) != string(valve.ServerListHeader) {
+		t.Fatalf("reply = %q, want a server list", reply)
+	}
+
+	// the reaper would have ticked again by now
+	time.Sleep(1500 * time.Millisecond)
+	misuses, closed := store.state()
+	if !closed {
+		t.Error("The store hasn't been closed")
+	}
+	if len(misuses) != 0 {
+		t.Errorf("The store has been misused: %v", misuses)
+	}
+	store.mu.Lock()
+	closeCalls := store.closeCalls
+	store.mu.Unlock()
+	if closeCalls != 1 {
+		t.Errorf("The store has been closed %d times, want 1", closeCalls)
+	}
+}
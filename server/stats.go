@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Stats holds the counters of a MasterServer
+type Stats struct {
+	// Received counts the packets read from the connection
+	Received uint64
+	// Dropped counts the packets dropped because the dispatch queue was full
+	Dropped uint64
+	// Malformed counts the packets which couldn't be decoded
+	Malformed uint64
+	// Rejected counts the heartbeats answering an unknown, expired or wrong challenge
+	Rejected uint64
+	// Failed counts the requests which failed for another reason, like a store error
+	Failed uint64
+	// Banned counts the packets ignored because their endpoint is banned
+	Banned uint64
+	// RateLimited counts the packets dropped by the rate limits of their IP address or subnet
+	RateLimited uint64
+	// Throttled counts the replies dropped because the response bytes budget was spent
+	Throttled uint64
+	// Handshakes counts the server list requests answered with a handshake challenge
+	Handshakes uint64
+	// SentBytes counts the bytes of the sent replies
+	SentBytes uint64
+}
+
+// Stats returns a snapshot of the server counters
+func (ms *MasterServer) Stats() Stats {
+	return Stats{
+		Received:    atomic.LoadUint64(&ms.stats.Received),
+		Dropped:     atomic.LoadUint64(&ms.stats.Dropped),
+		Malformed:   atomic.LoadUint64(&ms.stats.Malformed),
+		Rejected:    atomic.LoadUint64(&ms.stats.Rejected),
+		Failed:      atomic.LoadUint64(&ms.stats.Failed),
+		Banned:      atomic.LoadUint64(&ms.stats.Banned),
+		RateLimited: atomic.LoadUint64(&ms.stats.RateLimited),
+		Throttled:   atomic.LoadUint64(&ms.stats.Throttled),
+		Handshakes:  atomic.LoadUint64(&ms.stats.Handshakes),
+		SentBytes:   atomic.LoadUint64(&ms.stats.SentBytes),
+	}
+}
+
+// countError increments the counter matching a request error
+func (ms *MasterServer) countError(err error) {
+	switch {
+	case errors.Is(err, ErrMalformedRequest):
+		atomic.AddUint64(&ms.stats.Malformed, 1)
+	case isRejection(err):
+		atomic.AddUint64(&ms.stats.Rejected, 1)
+	default:
+		atomic.AddUint64(&ms.stats.Failed, 1)
+	}
+}
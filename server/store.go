@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jbltx/master-server/config"
+	"github.com/jbltx/master-server/valve"
+)
+
+// ErrNotFound is returned by a Store when the requested entry doesn't exist
+var ErrNotFound = errors.New("The entry hasn't been found in the store")
+
+// ServerQuery describes the game servers requested by a server list query
+type ServerQuery struct {
+	// After is the key of the last endpoint of the previous page, only the servers after it
+	// are returned. The first page starts after the empty key.
+	After EndpointKey
+	// ActiveSince excludes the servers without a heartbeat since this date
+	ActiveSince time.Time
+	Region      valve.Region
+	Filter      valve.Filter
+	// IPv4Only excludes the IPv6 servers, for the replies in the legacy format
+	IPv4Only bool
+	// VisibleOnly excludes the servers which haven't answered the A2S_INFO probes
+	VisibleOnly bool
+	// CollapseAddr keeps only the first matching server of each IP address, in the endpoints
+	// order. The IP address of After is skipped, its first server was on the previous page.
+	CollapseAddr bool
+	Limit        int64
+}
+
+// Store is the registry of game servers and challenges used by the MasterServer
+type Store interface {
+	// FindServers returns the servers matching the query, ordered by endpoint
+	FindServers(ctx context.Context, query *ServerQuery) ([]GameServer, error)
+	// SaveServer creates or updates a game server from its heartbeat
+	SaveServer(ctx context.Context, gameServer *GameServer) (created bool, err error)
+	// RemoveServer removes the game server registered with the endpoint
+	RemoveServer(ctx context.Context, endpoint *ServerEndpoint) (removed bool, err error)
+	// SaveChallenge creates or replaces the challenge of an endpoint
+	SaveChallenge(ctx context.Context, challenge *Challenge) (created bool, err error)
+	// TakeChallenge returns and removes the challenge of the endpoint, or ErrNotFound
+	TakeChallenge(ctx context.Context, endpoint *ServerEndpoint) (*Challenge, error)
+	// SaveProbe updates the game server registered with the endpoint from an A2S_INFO probe, or returns ErrNotFound
+	SaveProbe(ctx context.Context, endpoint *ServerEndpoint, result *ProbeResult) error
+	// SaveBan creates or replaces the ban of its network and port
+	SaveBan(ctx context.Context, ban *Ban) error
+	// RemoveBan removes the ban of the same network and port as the given one
+	RemoveBan(ctx context.Context, ban *Ban) (removed bool, err error)
+	// FindBans returns the bans which are active at the given date
+	FindBans(ctx context.Context, activeAt time.Time) ([]Ban, error)
+	// PurgeExpired removes the servers without heartbeat, the challenges issued and the bans expired before the given dates
+	PurgeExpired(ctx context.Context, serversBefore time.Time, challengesBefore time.Time, bansBefore time.Time) error
+	// Close releases the resources held by the store
+	Close(ctx context.Context) error
+}
+
+// NewStore creates the store selected by the database configuration
+func NewStore(ctx context.Context, cfg config.Config) (Store, error) {
+	switch cfg.Database.Driver {
+	case config.MongoDriver, "":
+		return newMongoStore(ctx, cfg)
+	case config.MemoryDriver:
+		return newMemoryStore(), nil
+	case config.BoltDriver:
+		return newBoltStore(cfg)
+	}
+	return nil, errors.New("The database driver " + cfg.Database.Driver + " is unknown")
+}
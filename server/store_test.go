@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jbltx/master-server/config"
+	"github.com/jbltx/master-server/valve"
+
+	"go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// testStores returns the stores which don't need an external service, the bolt one in a temporary file
+func testStores(t *testing.T) map[string]Store {
+	t.Helper()
+	cfg := config.NewDefaultConfig()
+	cfg.Database.Path = filepath.Join(t.TempDir(), "master-server.db")
+	bolt, err := newBoltStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { bolt.Close(context.Background()) })
+	return map[string]Store{
+		config.MemoryDriver: newMemoryStore(),
+		config.BoltDriver:   bolt,
+	}
+}
+
+func saveStoreServer(t *testing.T, store Store, endpoint string) {
+	t.Helper()
+	gameServer := NewGameServer(testEndpoint(t, endpoint), &valve.ChallengeRequest{Region: valve.Europe})
+	if _, err := store.SaveServer(context.Background(), gameServer); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// findStoreServerPages returns the endpoints of every page of the query
+func findStoreServerPages(t *testing.T, store Store, query ServerQuery) []string {
+	t.Helper()
+	endpoints := []string{}
+	for page := 0; ; page++ {
+		if page > 100 {
+			t.Fatalf("The query has too many pages: %v", endpoints)
+		}
+		servers, err := store.FindServers(context.Background(), &query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range servers {
+			endpoints = append(endpoints, NewServerEndpoint(&servers[i]).String())
+		}
+		if int64(len(servers)) < query.Limit {
+			return endpoints
+		}
+		query.After = servers[len(servers)-1].EndpointKey
+	}
+}
+
+func TestFindServersCollapseAddr(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for port := 27000; port < 27020; port++ {
+				saveStoreServer(t, store, "192.0.2.1:"+strconv.Itoa(port))
+			}
+			saveStoreServer(t, store, "192.0.2.2:27015")
+			saveStoreServer(t, store, "[2001:db8::1]:27015")
+			saveStoreServer(t, store, "[2001:db8::1]:27016")
+
+			query := ServerQuery{ActiveSince: time.Now().Add(-time.Minute), Region: valve.AllRegions, Limit: 3}
+			if got := findStoreServerPages(t, store, query); len(got) != 23 {
+				t.Errorf("FindServers() = %d servers, want 23", len(got))
+			}
+			query.CollapseAddr = true
+			want := []string{"192.0.2.1:27000", "192.0.2.2:27015", "[2001:db8::1]:27015"}
+			if got := findStoreServerPages(t, store, query); len(got) != len(want) || !equalEndpoints(got, want) {
+				t.Errorf("FindServers(collapse) = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestStoreKeysDontCollide(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// the legacy keys only had the port and the first 3 bytes of the address
+			endpoints := []string{"192.0.2.1:27015", "192.0.2.2:27015", "[2001:db8::1]:27015", "[2001:db8::2]:27015"}
+			for _, endpoint := range endpoints {
+				saveStoreServer(t, store, endpoint)
+			}
+			query := ServerQuery{ActiveSince: time.Now().Add(-time.Minute), Region: valve.AllRegions, Limit: 10}
+			if got := findStoreServerPages(t, store, query); !equalEndpoints(got, endpoints) {
+				t.Fatalf("FindServers() = %v, want %v", got, endpoints)
+			}
+
+			removed, err := store.RemoveServer(context.Background(), testEndpoint(t, "192.0.2.1:27015"))
+			if err != nil || !removed {
+				t.Fatalf("RemoveServer() = %v, %v, want true", removed, err)
+			}
+			want := endpoints[1:]
+			if got := findStoreServerPages(t, store, query); !equalEndpoints(got, want) {
+				t.Errorf("FindServers(after remove) = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestStoreKeysOrder(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, endpoint := range []string{"[2001:db8::1]:80", "192.0.2.10:27015", "192.0.2.9:27016", "[2001:db8::1]:27015", "192.0.2.9:27015", "10.0.0.1:27015", "192.0.2.9:9000"} {
+				saveStoreServer(t, store, endpoint)
+			}
+			// the IPv4 addresses are before the IPv6 ones, then the ports are in order for one address
+			want := []string{"10.0.0.1:27015", "192.0.2.9:9000", "192.0.2.9:27015", "192.0.2.9:27016", "192.0.2.10:27015", "[2001:db8::1]:80", "[2001:db8::1]:27015"}
+			for _, limit := range []int64{1, 2, 10} {
+				query := ServerQuery{ActiveSince: time.Now().Add(-time.Minute), Region: valve.AllRegions, Limit: limit}
+				if got := findStoreServerPages(t, store, query); !reflect.DeepEqual(got, want) {
+					t.Errorf("FindServers(limit %d) = %v, want %v", limit, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBoltMigratesLegacyKeys(t *testing.T) {
+	cfg := config.NewDefaultConfig()
+	cfg.Database.Path = filepath.Join(t.TempDir(), "master-server.db")
+
+	// a database written with the legacy keys, two of its servers shared the same key in the past
+	db, err := bbolt.Open(cfg.Database.Path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := []string{"192.0.2.2:27015", "[2001:db8::1]:27015", "192.0.2.1:27016"}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		servers, err := tx.CreateBucket(boltServersBucket)
+		if err != nil {
+			return err
+		}
+		for i, endpoint := range legacy {
+			gameServer := NewGameServer(testEndpoint(t, endpoint), &valve.ChallengeRequest{Region: valve.Europe})
+			gameServer.EndpointKey = ""
+			v, err := bson.Marshal(gameServer)
+			if err != nil {
+				return err
+			}
+			key := make([]byte, boltLegacyKeySize)
+			binary.BigEndian.PutUint64(key, uint64(i+1))
+			if err := servers.Put(key, v); err != nil {
+				return err
+			}
+		}
+		challenges, err := tx.CreateBucket(boltChallengesBucket)
+		if err != nil {
+			return err
+		}
+		return challenges.Put(make([]byte, boltLegacyKeySize), []byte{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := newBoltStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close(context.Background())
+	query := ServerQuery{ActiveSince: time.Now().Add(-time.Minute), Region: valve.AllRegions, Limit: 2}
+	want := []string{"192.0.2.1:27016", "192.0.2.2:27015", "[2001:db8::1]:27015"}
+	if got := findStoreServerPages(t, store, query); !reflect.DeepEqual(got, want) {
+		t.Fatalf("FindServers() = %v, want %v", got, want)
+	}
+	err = store.db.View(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{boltServersBucket, boltChallengesBucket} {
+			tx.Bucket(name).ForEach(func(k, v []byte) error {
+				if len(k) == boltLegacyKeySize {
+					t.Errorf("The legacy key %x is still in the %s bucket", k, name)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the migrated servers are updated in place by their next heartbeat
+	saveStoreServer(t, store, "192.0.2.2:27015")
+	if got := findStoreServerPages(t, store, query); !equalEndpoints(got, want) {
+		t.Errorf("FindServers(after heartbeat) = %v, want %v", got, want)
+	}
+}
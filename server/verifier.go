@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jbltx/master-server/valve"
+)
+
+const (
+	// maxProbeFailures is the number of probes in a row a visible server can miss before being hidden
+	maxProbeFailures = 3
+	// probeWorkers is the number of probes running at the same time
+	probeWorkers = 16
+)
+
+// ProbeResult is the outcome of an A2S_INFO probe, Info is nil when the server didn't answer
+type ProbeResult struct {
+	Date time.Time
+	Info *valve.ServerInfo
+}
+
+// applyProbe updates the game server with a probe result. A server becomes visible with
+// its first valid reply and is hidden again after maxProbeFailures missed probes.
+func (g *GameServer) applyProbe(result *ProbeResult) {
+	g.ProbeDate = result.Date
+	info := result.Info
+	if info == nil {
+		g.ProbeFailures++
+		if g.ProbeFailures >= maxProbeFailures {
+			g.Visible = false
+		}
+		return
+	}
+
+	g.Visible = true
+	g.ProbeFailures = 0
+	g.Name = info.Name
+	g.GameDir = info.Folder
+	g.Map = info.Map
+	g.Players = int32(info.Players)
+	g.Max = int32(info.MaxPlayers)
+	g.Bots = int32(info.Bots)
+	g.Type = string(info.ServerType)
+	g.OS = string(info.Environment.Normalize())
+	g.Password = info.Password
+	g.Secure = info.VAC
+	g.Version = info.Version
+	g.AppID = int32(info.AppID)
+	if info.GameID != 0 {
+		// the app ID is the low 24 bits of the game ID, the short field can't hold every ID
+		g.AppID = int32(info.GameID & 0xFFFFFF)
+	}
+	g.GameType = nil
+	if len(info.Keywords) > 0 {
+		g.GameType = strings.Split(info.Keywords, ",")
+	}
+}
+
+// keepProbe copies the fields written by the probes from the previous entry of the game server,
+// the app ID and game type are kept unless the heartbeat has them
+func (g *GameServer) keepProbe(previous *GameServer) {
+	g.Name = previous.Name
+	if g.AppID == 0 {
+		g.AppID = previous.AppID
+	}
+	if len(g.GameType) == 0 {
+		g.GameType = previous.GameType
+	}
+	g.Visible = previous.Visible
+	g.ProbeDate = previous.ProbeDate
+	g.ProbeFailures = previous.ProbeFailures
+}
+
+// verifier sends A2S_INFO queries to the registered game servers, so that only the
+// ones reachable on their address are listed. The new servers are probed as soon as
+// their first heartbeat is accepted, then all of them every ProbeInterval.
+type verifier struct {
+	ms       *MasterServer
+	interval time.Duration
+	timeout  time.Duration
+	queue    chan ServerEndpoint
+
+	mu      sync.Mutex
+	pending map[EndpointKey]bool
+}
+
+func (ms *MasterServer) newVerifier() *verifier {
+	return &verifier{
+		ms:       ms,
+		interval: time.Duration(ms.cfg.ProbeInterval) * time.Second,
+		timeout:  time.Duration(ms.cfg.ProbeTimeout) * time.Second,
+		queue:    make(chan ServerEndpoint, defaultQueueSize),
+		pending:  make(map[EndpointKey]bool),
+	}
+}
+
+// enqueue schedules a probe of the endpoint, unless one is already pending or the queue is full
+func (v *verifier) enqueue(endpoint *ServerEndpoint) {
+	key := endpoint.Key()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.pending[key] {
+		return
+	}
+	select {
+	case v.queue <- *endpoint:
+		v.pending[key] = true
+	default:
+		// the next sweep will try again
+	}
+}
+
+// run probes the queued endpoints and queues all the active servers every interval until done is closed
+func (v *verifier) run(ctx context.Context, done <-chan struct{}) {
+	var wg sync.WaitGroup
+	wg.Add(probeWorkers)
+	for i := 0; i < probeWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			v.work(ctx, done)
+		}()
+	}
+	defer wg.Wait()
+
+	ticker := time.NewTicker(v.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			v.sweep(ctx)
+		}
+	}
+}
+
+func (v *verifier) sweep(ctx context.Context) {
+	query := &ServerQuery{
+		ActiveSince: v.ms.heartbeatDeadline(),
+		Region:      valve.AllRegions,
+	}
+	gameServers, err := v.ms.store.FindServers(ctx, query)
+	if err != nil {
+		log.Println("[WARN] Unable to find the servers to probe: " + err.Error())
+		return
+	}
+	for i := range gameServers {
+		v.enqueue(NewServerEndpoint(&gameServers[i]))
+	}
+}
+
+func (v *verifier) work(ctx context.Context, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case endpoint := <-v.queue:
+			result := &ProbeResult{Date: time.Now()}
+			info, err := v.probe(ctx, &endpoint)
+			if err != nil {
+				log.Println("[WARN] PROBE - The A2S_INFO query failed (" + endpoint.String() + "): " + err.Error())
+			} else {
+				result.Info = info
+			}
+			if err = v.ms.store.SaveProbe(ctx, &endpoint, result); err != nil && err != ErrNotFound {
+				log.Println("[WARN] PROBE - Unable to save the probe result (" + endpoint.String() + "): " + err.Error())
+			}
+
+			v.mu.Lock()
+			delete(v.pending, endpoint.Key())
+			v.mu.Unlock()
+		}
+	}
+}
+
+// probe sends an A2S_INFO query to the endpoint
+func (v *verifier) probe(ctx context.Context, endpoint *ServerEndpoint) (*valve.ServerInfo, error) {
+	a2s := valve.NewA2SClient(endpoint.String())
+	a2s.Timeout = v.timeout
+	return a2s.Info(ctx)
+}
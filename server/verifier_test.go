@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jbltx/master-server/valve"
+)
+
+// infoTestReply is an A2S_INFO reply of a macOS server with its keywords and game ID
+var infoTestReply = []byte("\xff\xff\xff\xffI\x11Probed Server\x00ctf_2fort\x00tf\x00Team Fortress\x00\xb8\x01\x05\x18\x02dm\x00\x018622567\x00" +
+	"\x21" + "cp,increased_maxplayers\x00" + "\xb8\x01\x00\x00\x00\x00\x00\x00")
+
+// listenTestGameServer answers the A2S_INFO queries with infoTestReply until the test ends
+func listenTestGameServer(t *testing.T) *ServerEndpoint {
+	t.Helper()
+	connection, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connection.Close() })
+	go func() {
+		buffer := make([]byte, 1400)
+		for {
+			n, addr, err := connection.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			if n > len(valve.SimplePacketHeader) && buffer[len(valve.SimplePacketHeader)] == valve.A2SInfoRequestHeader {
+				connection.WriteToUDP(infoTestReply, addr)
+			}
+		}
+	}()
+	addr := connection.LocalAddr().(*net.UDPAddr)
+	return &ServerEndpoint{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+// waitProbe waits until the game server of the endpoint has been probed
+func waitProbe(t *testing.T, ms *MasterServer, endpoint *ServerEndpoint) *GameServer {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		servers, err := ms.store.FindServers(context.Background(), &ServerQuery{Region: valve.AllRegions, Limit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range servers {
+			if servers[i].EndpointKey == endpoint.Key() && !servers[i].ProbeDate.IsZero() {
+				return &servers[i]
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("The game server %s hasn't been probed", endpoint)
+	return nil
+}
+
+func TestVerifierListsAnsweringServers(t *testing.T) {
+	ms := newTestMasterServer(t)
+	ms.cfg.VerifyServers = true
+	ms.verifier = ms.newVerifier()
+
+	answering := listenTestGameServer(t)
+	silent := ServerEndpoint{IP: answering.IP, Port: freeUDPPort(t)}
+	registerTestServer(t, ms, answering, goldSrcTestHeartbeat)
+	registerTestServer(t, ms, &silent, goldSrcTestHeartbeat)
+
+	// the new servers are hidden until they answer
+	if got := listTestServers(t, ms, valve.AllRegions, ""); len(got) != 0 {
+		t.Fatalf("servers before the probes = %v, want none", got)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		ms.verifier.run(context.Background(), done)
+		close(stopped)
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+
+	probed := waitProbe(t, ms, answering)
+	if !probed.Visible || probed.Name != "Probed Server" || probed.Map != "ctf_2fort" || probed.Players != 5 {
+		t.Errorf("answering server = %+v", probed)
+	}
+	// the 'm' platform is stored like the heartbeats, and the app ID comes from the game ID
+	if probed.OS != valve.OSX || probed.AppID != 440 || !reflect.DeepEqual(probed.GameType, []string{"cp", "increased_maxplayers"}) {
+		t.Errorf("answering server OS = %q, app ID = %d, game type = %v", probed.OS, probed.AppID, probed.GameType)
+	}
+	failed := waitProbe(t, ms, &silent)
+	if failed.Visible || failed.ProbeFailures != 1 {
+		t.Errorf("silent server visible = %v with %d failures, want hidden with 1 failure", failed.Visible, failed.ProbeFailures)
+	}
+
+	if got, want := listTestServers(t, ms, valve.AllRegions, ""), []string{answering.String()}; !equalEndpoints(got, want) {
+		t.Errorf("servers after the probes = %v, want %v", got, want)
+	}
+}
+
+func TestApplyProbe(t *testing.T) {
+	info := &valve.ServerInfo{Name: "Probed Server", Map: "de_dust2", Environment: "l", AppID: 10}
+	gameServer := &GameServer{}
+
+	// a server which never answered stays hidden
+	gameServer.applyProbe(&ProbeResult{Date: time.Now()})
+	if gameServer.Visible || gameServer.ProbeFailures != 1 {
+		t.Fatalf("after a failure: visible = %v, failures = %d", gameServer.Visible, gameServer.ProbeFailures)
+	}
+
+	gameServer.applyProbe(&ProbeResult{Date: time.Now(), Info: info})
+	if !gameServer.Visible || gameServer.ProbeFailures != 0 || gameServer.Name != info.Name {
+		t.Fatalf("after a reply: visible = %v, failures = %d, name = %q", gameServer.Visible, gameServer.ProbeFailures, gameServer.Name)
+	}
+
+	// a visible server misses a few probes before being hidden
+	for failures := int32(1); failures <= maxProbeFailures; failures++ {
+		gameServer.applyProbe(&ProbeResult{Date: time.Now()})
+		if want := failures < maxProbeFailures; gameServer.Visible != want || gameServer.ProbeFailures != failures {
+			t.Errorf("after %d failures: visible = %v, failures = %d, want visible = %v", failures, gameServer.Visible, gameServer.ProbeFailures, want)
+		}
+	}
+	// the probed values are kept while the server is hidden
+	if gameServer.Name != info.Name || gameServer.Map != info.Map {
+		t.Errorf("hidden server = %+v", gameServer)
+	}
+
+	gameServer.applyProbe(&ProbeResult{Date: time.Now(), Info: info})
+	if !gameServer.Visible || gameServer.ProbeFailures != 0 {
+		t.Errorf("after a new reply: visible = %v, failures = %d", gameServer.Visible, gameServer.ProbeFailures)
+	}
+}
+
+func TestSaveServerKeepsProbe(t *testing.T) {
+	ms := newTestMasterServer(t)
+	ctx := context.Background()
+	endpoint := testEndpoint(t, "192.0.2.1:27015")
+	registerTestServer(t, ms, endpoint, goldSrcTestHeartbeat)
+
+	info := &valve.ServerInfo{Name: "Probed Server", Map: "de_dust2", Environment: "l", Keywords: "casual"}
+	if err := ms.store.SaveProbe(ctx, endpoint, &ProbeResult{Date: time.Now(), Info: info}); err != nil {
+		t.Fatal(err)
+	}
+	// the next heartbeat doesn't hide the server nor forget its name
+	registerTestServer(t, ms, endpoint, goldSrcTestHeartbeat)
+	servers, err := ms.store.FindServers(ctx, &ServerQuery{Region: valve.AllRegions, VisibleOnly: true, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 || servers[0].Name != info.Name || !reflect.DeepEqual(servers[0].GameType, []string{"casual"}) {
+		t.Errorf("servers after the heartbeat = %+v", servers)
+	}
+
+	// the probes of the removed servers are ignored
+	if _, err := ms.store.RemoveServer(ctx, endpoint); err != nil {
+		t.Fatal(err)
+	}
+	if err := ms.store.SaveProbe(ctx, endpoint, &ProbeResult{Date: time.Now(), Info: info}); err != ErrNotFound {
+		t.Errorf("SaveProbe(removed server) = %v, want %v", err, ErrNotFound)
+	}
+}
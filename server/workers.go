@@ -0,0 +1,99 @@
+package server
+
+import (
+	"log"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultQueueSize is the dispatch queue capacity when the configuration doesn't set it
+const defaultQueueSize = 1024
+
+// packetJob is a packet waiting in the dispatch queue
+type packetJob struct {
+	packet []byte
+	addr   *net.UDPAddr
+}
+
+// workerPool handles the received packets on a bounded number of goroutines.
+// The packets are dropped when the queue is full, so a burst can't make the
+// server read late and let the kernel socket buffer overflow silently.
+type workerPool struct {
+	ms         *MasterServer
+	connection *net.UDPConn
+	queue      chan packetJob
+	wg         sync.WaitGroup
+}
+
+func (ms *MasterServer) newWorkerPool(connection *net.UDPConn) *workerPool {
+	workers := int(ms.cfg.Workers)
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	queueSize := int(ms.cfg.QueueSize)
+	if queueSize == 0 {
+		queueSize = defaultQueueSize
+	}
+	pool := &workerPool{
+		ms:         ms,
+		connection: connection,
+		queue:      make(chan packetJob, queueSize),
+	}
+	pool.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go pool.run()
+	}
+	return pool
+}
+
+// dispatch queues a packet, the packet slice is owned by the pool afterward.
+// It returns false when the queue is full and the packet has been dropped.
+func (pool *workerPool) dispatch(packet []byte, addr *net.UDPAddr) bool {
+	select {
+	case pool.queue <- packetJob{packet: packet, addr: addr}:
+		return true
+	default:
+		atomic.AddUint64(&pool.ms.stats.Dropped, 1)
+		return false
+	}
+}
+
+// close stops accepting packets and waits for the queued ones to be handled
+func (pool *workerPool) close() {
+	close(pool.queue)
+	pool.wg.Wait()
+}
+
+func (pool *workerPool) run() {
+	defer pool.wg.Done()
+	for job := range pool.queue {
+		endpoint := &ServerEndpoint{
+			IP:   job.addr.IP,
+			Port: uint16(job.addr.Port),
+		}
+
+		response, err := pool.ms.handlePacket(pool.ms.handlersCtx, job.packet, endpoint)
+		if err != nil {
+			pool.ms.countError(err)
+			log.Println("[WARN] " + err.Error())
+			continue
+		}
+
+		if response == nil {
+			continue
+		}
+		if !pool.ms.limits.allowResponse(len(response), time.Now()) {
+			atomic.AddUint64(&pool.ms.stats.Throttled, 1)
+			continue
+		}
+		// a UDPConn is safe for concurrent use, the workers share it to reply
+		if _, err = pool.connection.WriteToUDP(response, job.addr); err != nil {
+			log.Println("[WARN] Unable to send the reply (" + endpoint.String() + "): " + err.Error())
+			continue
+		}
+		atomic.AddUint64(&pool.ms.stats.SentBytes, uint64(len(response)))
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jbltx/master-server/config"
+	"github.com/jbltx/master-server/valve"
+)
+
+// blockingStore holds the selected operations until release is closed,
+// and records the operations used while or after the store is closed
+type blockingStore struct {
+	Store
+	blockFind  bool
+	blockPurge bool
+	entered    chan string
+	release    chan struct{}
+
+	mu         sync.Mutex
+	inFlight   int
+	closed     bool
+	misuses    []string
+	closeCalls int
+}
+
+func newBlockingStore() *blockingStore {
+	return &blockingStore{
+		Store:   newMemoryStore(),
+		entered: make(chan string, 64),
+		release: make(chan struct{}),
+	}
+}
+
+func (s *blockingStore) begin(operation string, block bool) {
+	s.mu.Lock()
+	if s.closed {
+		s.misuses = append(s.misuses, operation+" after Close")
+	}
+	s.inFlight++
+	s.mu.Unlock()
+	if block {
+		s.entered <- operation
+		<-s.release
+	}
+}
+
+func (s *blockingStore) end() {
+	s.mu.Lock()
+	s.inFlight--
+	s.mu.Unlock()
+}
+
+func (s *blockingStore) FindServers(ctx context.Context, query *ServerQuery) ([]GameServer, error) {
+	s.begin("FindServers", s.blockFind)
+	defer s.end()
+	return s.Store.FindServers(ctx, query)
+}
+
+func (s *blockingStore) PurgeExpired(ctx context.Context, serversBefore time.Time, challengesBefore time.Time, bansBefore time.Time) error {
+	s.begin("PurgeExpired", s.blockPurge)
+	defer s.end()
+	return s.Store.PurgeExpired(ctx, serversBefore, challengesBefore, bansBefore)
+}
+
+func (s *blockingStore) FindBans(ctx context.Context, activeAt time.Time) ([]Ban, error) {
+	s.begin("FindBans", false)
+	defer s.end()
+	return s.Store.FindBans(ctx, activeAt)
+}
+
+func (s *blockingStore) Close(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight > 0 {
+		s.misuses = append(s.misuses, "Close while an operation is running")
+	}
+	s.closed = true
+	s.closeCalls++
+	return s.Store.Close(ctx)
+}
+
+func (s *blockingStore) state() (misuses []string, closed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.misuses...), s.closed
+}
+
+func (s *blockingStore) waitEntered(t *testing.T, operation string) {
+	t.Helper()
+	select {
+	case entered := <-s.entered:
+		if entered != operation {
+			t.Fatalf("%s has been called, want %s", entered, operation)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s hasn't been called", operation)
+	}
+}
+
+func waitStats(ms *MasterServer, done func(Stats) bool) Stats {
+	deadline := time.Now().Add(2 * time.Second)
+	for !done(ms.Stats()) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return ms.Stats()
+}
+
+func TestListenDropsWhenQueueIsFull(t *testing.T) {
+	store := newBlockingStore()
+	store.blockFind = true
+	ms := newTestMasterServerWith(t, store, func(cfg *config.Config) {
+		cfg.Workers = 1
+		cfg.QueueSize = 2
+	})
+	addr := listenTestMasterServer(t, ms)
+	defer func() {
+		select {
+		case <-store.release:
+		default:
+			close(store.release)
+		}
+	}()
+
+	connection, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+	list, err := valve.MarshallServerListRequest(&valve.ServerListRequest{Region: valve.AllRegions, Seed: valve.NullSeed})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the single worker is held by the first request, the queue takes two more and the others are dropped
+	exchangeTestPacket(t, connection, valve.MarshallJoinRequest())
+	if _, err := connection.Write(list); err != nil {
+		t.Fatal(err)
+	}
+	store.waitEntered(t, "FindServers")
+	const sent = 10
+	for i := 0; i < sent; i++ {
+		if _, err := connection.Write(list); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := waitStats(ms, func(s Stats) bool { return s.Received == sent+2 })
+	if stats.Received != sent+2 || stats.Dropped != sent-2 {
+		t.Fatalf("Stats() = %+v, want %d received and %d dropped", stats, sent+2, sent-2)
+	}
+
+	// the queued requests are answered once the worker is released
+	close(store.release)
+	buffer := make([]byte, maxRequestSize)
+	for i := 0; i < 3; i++ {
+		connection.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := connection.Read(buffer)
+		if err != nil {
+			t.Fatalf("The reply %d hasn't been received: %v", i, err)
+		}
+		if reply := buffer[:n]; len(reply) < len(valve.ServerListHeader) || string(reply[:len(valve.ServerListHeader)]) != string(valve.ServerListHeader) {
+			t.Fatalf("reply %d = %q, want a server list", i, reply)
+		}
+	}
+	connection.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := connection.Read(buffer); err == nil {
+		t.Error("A dropped request has been answered")
+	}
+}
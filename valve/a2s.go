@@ -0,0 +1,199 @@
+package valve
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Headers of the Source Engine server queries (A2S), the game servers answer them on their game port
+const (
+	// A2SInfoRequestHeader : A2S_INFO request
+	A2SInfoRequestHeader   byte = 0x54
+	A2SPlayerRequestHeader byte = 0x55
+	A2SRulesRequestHeader  byte = 0x56
+	A2SInfoHeader          byte = 0x49
+	A2SPlayerHeader        byte = 0x44
+	A2SRulesHeader         byte = 0x45
+	A2SChallengeHeader     byte = 0x41
+)
+
+var (
+	// SimplePacketHeader starts the A2S packets sent in a single datagram
+	SimplePacketHeader []byte = []byte{0xFF, 0xFF, 0xFF, 0xFF}
+	// SplitPacketHeader starts each part of an A2S reply split in several datagrams
+	SplitPacketHeader []byte = []byte{0xFF, 0xFF, 0xFF, 0xFE}
+	a2sInfoPayload    []byte = []byte("Source Engine Query\x00")
+	// a2sNoChallenge asks the server for a challenge in the player and rules requests
+	a2sNoChallenge []byte = []byte{0xFF, 0xFF, 0xFF, 0xFF}
+)
+
+// Extra Data Flags of an A2S_INFO reply, telling which optional fields follow the version
+const (
+	infoEDFPort     byte = 0x80
+	infoEDFSteamID  byte = 0x10
+	infoEDFSourceTV byte = 0x40
+	infoEDFKeywords byte = 0x20
+	infoEDFGameID   byte = 0x01
+)
+
+// ServerInfo is the body of an A2S_INFO reply (0x49)
+type ServerInfo struct {
+	Protocol    uint8
+	Name        string
+	Map         string
+	Folder      string
+	Game        string
+	AppID       uint16
+	Players     uint8
+	MaxPlayers  uint8
+	Bots        uint8
+	ServerType  ServerType
+	Environment OperatingSystem
+	Password    bool
+	VAC         bool
+	Version     string
+	// the following fields are only set when the server sends them
+	Port         uint16
+	SteamID      uint64
+	SourceTVPort uint16
+	SourceTVName string
+	Keywords     string
+	GameID       uint64
+}
+
+// MarshallInfoRequest builds an A2S_INFO request, the challenge is the one sent
+// by the server in an A2S challenge reply (0x41), nil for the first request
+func MarshallInfoRequest(challenge []byte) []byte {
+	buffer := new(bytes.Buffer)
+	buffer.Write(SimplePacketHeader)
+	buffer.WriteByte(A2SInfoRequestHeader)
+	buffer.Write(a2sInfoPayload)
+	buffer.Write(challenge)
+	return buffer.Bytes()
+}
+
+// Player is an entry of an A2S_PLAYER reply (0x44)
+type Player struct {
+	Index uint8
+	Name  string
+	Score int32
+	// Duration is the time in seconds the player has been connected
+	Duration float32
+}
+
+// Rule is an entry of an A2S_RULES reply (0x45), a server console variable
+type Rule struct {
+	Name  string
+	Value string
+}
+
+// MarshallPlayerRequest builds an A2S_PLAYER request, the challenge is nil for the first request
+func MarshallPlayerRequest(challenge []byte) []byte {
+	return marshallChallengedRequest(A2SPlayerRequestHeader, challenge)
+}
+
+// MarshallRulesRequest builds an A2S_RULES request, the challenge is nil for the first request
+func MarshallRulesRequest(challenge []byte) []byte {
+	return marshallChallengedRequest(A2SRulesRequestHeader, challenge)
+}
+
+func marshallChallengedRequest(header byte, challenge []byte) []byte {
+	if challenge == nil {
+		challenge = a2sNoChallenge
+	}
+	buffer := new(bytes.Buffer)
+	buffer.Write(SimplePacketHeader)
+	buffer.WriteByte(header)
+	buffer.Write(challenge)
+	return buffer.Bytes()
+}
+
+// UnmarshallChallengeReply parses the body of an A2S challenge reply,
+// which is the 4 bytes challenge to append to the next request
+func UnmarshallChallengeReply(message []byte) ([]byte, error) {
+	if len(message) < 4 {
+		return nil, errors.New("The A2S challenge reply is too short")
+	}
+	return message[:4], nil
+}
+
+// UnmarshallServerInfo parses the body of an A2S_INFO reply, after its header byte
+func UnmarshallServerInfo(message []byte, ret *ServerInfo) error {
+	r := NewDecoder(message, binary.LittleEndian)
+	ret.Protocol = r.Byte()
+	ret.Name = r.String()
+	ret.Map = r.String()
+	ret.Folder = r.String()
+	ret.Game = r.String()
+	ret.AppID = r.Uint16()
+	ret.Players = r.Byte()
+	ret.MaxPlayers = r.Byte()
+	ret.Bots = r.Byte()
+	ret.ServerType = ServerType(r.Byte())
+	ret.Environment = OperatingSystem(r.Byte())
+	ret.Password = r.Byte() == 1
+	ret.VAC = r.Byte() == 1
+	ret.Version = r.String()
+	if r.Err() != nil {
+		return r.Err()
+	}
+	if r.Remaining() == 0 {
+		return nil
+	}
+
+	edf := r.Byte()
+	if edf&infoEDFPort != 0 {
+		ret.Port = r.Uint16()
+	}
+	if edf&infoEDFSteamID != 0 {
+		ret.SteamID = r.Uint64()
+	}
+	if edf&infoEDFSourceTV != 0 {
+		ret.SourceTVPort = r.Uint16()
+		ret.SourceTVName = r.String()
+	}
+	if edf&infoEDFKeywords != 0 {
+		ret.Keywords = r.String()
+	}
+	if edf&infoEDFGameID != 0 {
+		ret.GameID = r.Uint64()
+	}
+	return r.Err()
+}
+
+// UnmarshallPlayers parses the body of an A2S_PLAYER reply, after its header byte
+func UnmarshallPlayers(message []byte) ([]Player, error) {
+	r := NewDecoder(message, binary.LittleEndian)
+	count := int(r.Byte())
+	players := make([]Player, 0, count)
+	for i := 0; i < count && r.Err() == nil; i++ {
+		players = append(players, Player{
+			Index:    r.Byte(),
+			Name:     r.String(),
+			Score:    r.Int32(),
+			Duration: r.Float32(),
+		})
+	}
+	if r.Err() != nil {
+		return nil, r.Err()
+	}
+	return players, nil
+}
+
+// UnmarshallRules parses the body of an A2S_RULES reply, after its header byte
+func UnmarshallRules(message []byte) ([]Rule, error) {
+	r := NewDecoder(message, binary.LittleEndian)
+	count := int(r.Uint16())
+	rules := make([]Rule, 0, count)
+	for i := 0; i < count && r.Err() == nil; i++ {
+		rules = append(rules, Rule{
+			Name:  r.String(),
+			Value: r.String(),
+		})
+	}
+	if r.Err() != nil {
+		return nil, r.Err()
+	}
+	return rules, nil
+}
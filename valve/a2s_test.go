@@ -0,0 +1,109 @@
+package valve
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshallServerInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    ServerInfo
+	}{
+		{
+			// the A2S_INFO example of the Valve developer wiki
+			"without extra data",
+			"02" + "67616d653278732e636f6d20436f756e7465722d537472696b6520536f75726365202331" + "00" + "64655f64757374" + "00" +
+				"63737472696b65" + "00" + "436f756e7465722d537472696b653a20536f75726365" + "00" +
+				"f000" + "05" + "10" + "04" + "64" + "6c" + "00" + "00" + "312e302e302e3232" + "00",
+			ServerInfo{
+				Protocol: 2, Name: "game2xs.com Counter-Strike Source #1", Map: "de_dust", Folder: "cstrike",
+				Game: "Counter-Strike: Source", AppID: 240, Players: 5, MaxPlayers: 16, Bots: 4,
+				ServerType: "d", Environment: "l", Version: "1.0.0.22",
+			},
+		},
+		{
+			"with every extra data",
+			"11" + "7466" + "00" + "6374665f32666f7274" + "00" + "7466" + "00" + "5446" + "00" +
+				"b801" + "18" + "20" + "00" + "64" + "6d" + "01" + "01" + "38363232353637" + "00" +
+				"f1" + "8769" + "0100000000000190" + "9069" + "5354" + "00" + "6370" + "00" + "b801000000000000",
+			ServerInfo{
+				Protocol: 17, Name: "tf", Map: "ctf_2fort", Folder: "tf", Game: "TF", AppID: 440,
+				Players: 24, MaxPlayers: 32, ServerType: "d", Environment: "m", Password: true, VAC: true,
+				Version: "8622567", Port: 27015, SteamID: 0x9001000000000001, SourceTVPort: 27024,
+				SourceTVName: "ST", Keywords: "cp", GameID: 440,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got ServerInfo
+			if err := UnmarshallServerInfo(mustDecodeHex(t, tt.message), &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("UnmarshallServerInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	// truncated before the version, and in the extra data
+	for _, message := range []string{"02" + "6100" + "6200" + "6300" + "6400" + "f000050a", "11" + "00000000" + "b801000000646c0000" + "00" + "80" + "87"} {
+		var info ServerInfo
+		if err := UnmarshallServerInfo(mustDecodeHex(t, message), &info); err == nil {
+			t.Errorf("UnmarshallServerInfo(%s) = %+v, want an error", message, info)
+		}
+	}
+}
+
+func TestUnmarshallPlayers(t *testing.T) {
+	// the A2S_PLAYER example of the Valve developer wiki
+	message := mustDecodeHex(t, "02"+
+		"01"+"5b445d2d2d2d2d3e542e4e2e57"+"00"+"0e000000"+"b4970044"+
+		"02"+"4b696c6c657220212121"+"00"+"05000000"+"6924d943")
+	players, err := UnmarshallPlayers(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Player{
+		{Index: 1, Name: "[D]---->T.N.W", Score: 14, Duration: 514.37},
+		{Index: 2, Name: "Killer !!!", Score: 5, Duration: 434.28},
+	}
+	if len(players) != len(want) {
+		t.Fatalf("UnmarshallPlayers() = %+v, want %+v", players, want)
+	}
+	for i := range want {
+		got := players[i]
+		if got.Index != want[i].Index || got.Name != want[i].Name || got.Score != want[i].Score || math.Abs(float64(got.Duration-want[i].Duration)) > 0.01 {
+			t.Errorf("player %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+
+	if players, err := UnmarshallPlayers(mustDecodeHex(t, "00")); err != nil || len(players) != 0 {
+		t.Errorf("UnmarshallPlayers(no player) = %+v, %v", players, err)
+	}
+	// the count announces more players than the reply holds
+	if _, err := UnmarshallPlayers(message[:len(message)-1]); err == nil {
+		t.Error("UnmarshallPlayers(truncated) should fail")
+	}
+}
+
+func TestUnmarshallRules(t *testing.T) {
+	message := mustDecodeHex(t, "0300"+
+		"6d705f74696d656c696d6974"+"00"+"3330"+"00"+
+		"73765f67726176697479"+"00"+"383030"+"00"+
+		"73765f70617373776f7264"+"00"+""+"00")
+	rules, err := UnmarshallRules(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rule{{"mp_timelimit", "30"}, {"sv_gravity", "800"}, {"sv_password", ""}}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("UnmarshallRules() = %+v, want %+v", rules, want)
+	}
+	if _, err := UnmarshallRules(message[:len(message)-1]); err == nil {
+		t.Error("UnmarshallRules(truncated) should fail")
+	}
+}
@@ -0,0 +1,281 @@
+package valve
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultA2STimeout is the delay to get a reply when A2SClient.Timeout is zero
+	DefaultA2STimeout = 3 * time.Second
+	// maxA2SChallenges is the number of A2S challenges answered before a query gives up
+	maxA2SChallenges = 2
+	// maxA2SPacketSize is the biggest datagram a game server sends
+	maxA2SPacketSize = 4096
+)
+
+var (
+	// ErrA2SChecksum is returned when a compressed split reply doesn't match its checksum
+	ErrA2SChecksum = errors.New("The decompressed A2S reply doesn't match its checksum")
+	// ErrA2SReplySize is returned when a compressed split reply announces a size bigger than its parts can hold
+	ErrA2SReplySize = errors.New("The decompressed A2S reply is too big")
+	errA2SSplitPart = errors.New("The A2S split packet is malformed")
+)
+
+// A2SClient queries a single game server with the Source Engine queries (A2S_INFO, A2S_PLAYER and A2S_RULES)
+type A2SClient struct {
+	// Address is the host:port of the game server
+	Address string
+	// Dialect selects the format of the split replies, the Source ones may be bzip2-compressed
+	Dialect Dialect
+	// Timeout bounds each query, including the challenge exchange and the split parts
+	Timeout time.Duration
+}
+
+// NewA2SClient creates a client querying the Source game server at the given host:port
+func NewA2SClient(address string) *A2SClient {
+	return &A2SClient{
+		Address: address,
+		Dialect: SourceDialect,
+		Timeout: DefaultA2STimeout,
+	}
+}
+
+// Info sends an A2S_INFO query
+func (c *A2SClient) Info(ctx context.Context) (*ServerInfo, error) {
+	body, err := c.query(ctx, MarshallInfoRequest, A2SInfoHeader)
+	if err != nil {
+		return nil, err
+	}
+	info := &ServerInfo{}
+	if err = UnmarshallServerInfo(body, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Players sends an A2S_PLAYER query
+func (c *A2SClient) Players(ctx context.Context) ([]Player, error) {
+	body, err := c.query(ctx, MarshallPlayerRequest, A2SPlayerHeader)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshallPlayers(body)
+}
+
+// Rules sends an A2S_RULES query
+func (c *A2SClient) Rules(ctx context.Context) ([]Rule, error) {
+	body, err := c.query(ctx, MarshallRulesRequest, A2SRulesHeader)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshallRules(body)
+}
+
+// query sends the request built by marshall, answers the A2S challenges
+// and returns the body of the reply following the expected header
+func (c *A2SClient) query(ctx context.Context, marshall func(challenge []byte) []byte, header byte) ([]byte, error) {
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultA2STimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var dialer net.Dialer
+	connection, err := dialer.DialContext(ctx, "udp", c.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer connection.Close()
+	deadline, _ := ctx.Deadline()
+	connection.SetDeadline(deadline)
+	// a canceled context unblocks the pending read
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			connection.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	request := marshall(nil)
+	for i := 0; i <= maxA2SChallenges; i++ {
+		if _, err = connection.Write(request); err != nil {
+			return nil, err
+		}
+		reply, err := c.readReply(connection)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if len(reply) == 0 {
+			return nil, errors.New("The A2S reply is empty")
+		}
+		switch reply[0] {
+		case A2SChallengeHeader:
+			challenge, err := UnmarshallChallengeReply(reply[1:])
+			if err != nil {
+				return nil, err
+			}
+			request = marshall(challenge)
+		case header:
+			return reply[1:], nil
+		default:
+			return nil, fmt.Errorf("The A2S reply header 0x%02x is unexpected", reply[0])
+		}
+	}
+	return nil, errors.New("The server kept answering with A2S challenges")
+}
+
+// readReply reads a reply, reassembling it when it's split in several packets,
+// and returns it without the simple packet header
+func (c *A2SClient) readReply(connection net.Conn) ([]byte, error) {
+	buffer := make([]byte, maxA2SPacketSize)
+	var reply *splitReply
+	for {
+		n, err := connection.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		packet := buffer[:n]
+		switch {
+		case bytes.HasPrefix(packet, SimplePacketHeader):
+			return append([]byte{}, packet[len(SimplePacketHeader):]...), nil
+		case bytes.HasPrefix(packet, SplitPacketHeader):
+			part, err := c.parseSplitPart(packet[len(SplitPacketHeader):])
+			if err != nil {
+				return nil, err
+			}
+			if reply == nil {
+				reply = newSplitReply(part)
+			} else if part.id != reply.id || part.total != len(reply.parts) {
+				// a late part of a previous reply
+				continue
+			}
+			reply.add(part)
+			if reply.complete() {
+				return reply.assemble()
+			}
+		default:
+			return nil, errors.New("The A2S reply header is invalid")
+		}
+	}
+}
+
+// splitPart is a packet of a split reply
+type splitPart struct {
+	id         uint32
+	total      int
+	number     int
+	compressed bool
+	// size and checksum of the decompressed reply, only in the first part of a compressed reply
+	size     uint32
+	checksum uint32
+	payload  []byte
+}
+
+// parseSplitPart parses a split packet after its header, in the format of the client dialect
+func (c *A2SClient) parseSplitPart(packet []byte) (*splitPart, error) {
+	if len(packet) < 5 {
+		return nil, errA2SSplitPart
+	}
+	part := &splitPart{id: binary.LittleEndian.Uint32(packet)}
+	if c.Dialect == GoldSrcDialect {
+		// the packet number is in the upper 4 bits, the packets count in the lower ones
+		part.number = int(packet[4] >> 4)
+		part.total = int(packet[4] & 0x0F)
+		part.payload = packet[5:]
+	} else {
+		if len(packet) < 8 {
+			return nil, errA2SSplitPart
+		}
+		part.total = int(packet[4])
+		part.number = int(packet[5])
+		// packet[6:8] is the maximum packet size the server uses
+		part.payload = packet[8:]
+		part.compressed = part.id&0x80000000 != 0
+		if part.compressed && part.number == 0 {
+			if len(part.payload) < 8 {
+				return nil, errA2SSplitPart
+			}
+			part.size = binary.LittleEndian.Uint32(part.payload)
+			part.checksum = binary.LittleEndian.Uint32(part.payload[4:])
+			part.payload = part.payload[8:]
+		}
+	}
+	if part.total == 0 || part.number >= part.total {
+		return nil, errA2SSplitPart
+	}
+	part.payload = append([]byte{}, part.payload...)
+	return part, nil
+}
+
+// splitReply collects the parts of a split reply, they can arrive in any order
+type splitReply struct {
+	id       uint32
+	parts    []*splitPart
+	received int
+}
+
+func newSplitReply(part *splitPart) *splitReply {
+	return &splitReply{
+		id:    part.id,
+		parts: make([]*splitPart, part.total),
+	}
+}
+
+func (r *splitReply) add(part *splitPart) {
+	if r.parts[part.number] == nil {
+		r.received++
+	}
+	r.parts[part.number] = part
+}
+
+func (r *splitReply) complete() bool {
+	return r.received == len(r.parts)
+}
+
+// assemble joins the parts, decompresses them if needed and strips the simple packet header
+func (r *splitReply) assemble() ([]byte, error) {
+	buffer := new(bytes.Buffer)
+	for _, part := range r.parts {
+		buffer.Write(part.payload)
+	}
+	reply := buffer.Bytes()
+
+	first := r.parts[0]
+	if first.compressed {
+		// a decompressed reply isn't bigger than the parts of an uncompressed one, and the
+		// decompression stops past the announced size so a bzip2 bomb can't exhaust the memory
+		if uint64(first.size) > uint64(maxA2SPacketSize)*uint64(len(r.parts)) {
+			return nil, ErrA2SReplySize
+		}
+		decompressed, err := ioutil.ReadAll(io.LimitReader(bzip2.NewReader(bytes.NewReader(reply)), int64(first.size)+1))
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(decompressed)) != first.size || crc32.ChecksumIEEE(decompressed) != first.checksum {
+			return nil, ErrA2SChecksum
+		}
+		reply = decompressed
+	}
+
+	if !bytes.HasPrefix(reply, SimplePacketHeader) {
+		return nil, errors.New("The assembled A2S reply header is invalid")
+	}
+	return reply[len(SimplePacketHeader):], nil
+}
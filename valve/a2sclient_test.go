@@ -0,0 +1,267 @@
+package valve
+
+import (
+	"context"
+	"encoding/hex"
+	"hash/crc32"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSplitReplyAssembleCompressed(t *testing.T) {
+	// bzip2 of FF FF FF FF "Ihello"
+	hello := mustDecodeHex(t, "425a68393141592653594cccabab0000054500c000002002448000a000310c00c4c2651ca29de2ee48a70a120999957560")
+	// bzip2 of FF FF FF FF followed by 1 MiB of null bytes
+	bomb := mustDecodeHex(t, "425a6839314159265359ffffffff00282cc000c0040008a00030cd340a54da9b0403a4201d6f8bb9229c28487fffffff80")
+	helloReply := []byte("\xff\xff\xff\xffIhello")
+
+	tests := []struct {
+		name     string
+		size     uint32
+		checksum uint32
+		payload  []byte
+		want     string
+		err      error
+	}{
+		{"valid", uint32(len(helloReply)), crc32.ChecksumIEEE(helloReply), hello, "Ihello", nil},
+		{"wrong checksum", uint32(len(helloReply)), 0, hello, "", ErrA2SChecksum},
+		{"bomb with its real size", 4 + 1<<20, 0, bomb, "", ErrA2SReplySize},
+		{"bomb with a small size", 16, 0, bomb, "", ErrA2SChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			part := &splitPart{
+				id:         0x80000001,
+				total:      1,
+				compressed: true,
+				size:       tt.size,
+				checksum:   tt.checksum,
+				payload:    tt.payload,
+			}
+			reply := newSplitReply(part)
+			reply.add(part)
+			got, err := reply.assemble()
+			if err != tt.err {
+				t.Fatalf("assemble() error = %v, want %v", err, tt.err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("assemble() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// listenTestA2SServer answers each request with the packets returned by reply, it's closed by the test cleanup
+func listenTestA2SServer(t *testing.T, reply func(request []byte) [][]byte) string {
+	t.Helper()
+	connection, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { connection.Close() })
+	go func() {
+		buffer := make([]byte, maxA2SPacketSize)
+		for {
+			n, addr, err := connection.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			for _, packet := range reply(append([]byte{}, buffer[:n]...)) {
+				connection.WriteToUDP(packet, addr)
+			}
+		}
+	}()
+	return connection.LocalAddr().String()
+}
+
+func newTestA2SClient(address string) *A2SClient {
+	c := NewA2SClient(address)
+	c.Timeout = 2 * time.Second
+	return c
+}
+
+const (
+	// testA2SPlayers is the body of an A2S_PLAYER reply with one player
+	testA2SPlayers = "\x01\x00Player\x00\x0a\x00\x00\x00\x00\x00\x80\x3f"
+	// testA2SRules is the body of an A2S_RULES reply with two rules
+	testA2SRules = "\x02\x00mp_timelimit\x0030\x00sv_gravity\x00800\x00"
+)
+
+func TestA2SClientChallenge(t *testing.T) {
+	challenge := "\x12\x34\x56\x78"
+	requests := make(chan string, 10)
+	address := listenTestA2SServer(t, func(request []byte) [][]byte {
+		requests <- string(request)
+		switch string(request) {
+		case string(MarshallPlayerRequest([]byte(challenge))):
+			return [][]byte{[]byte("\xff\xff\xff\xffD" + testA2SPlayers)}
+		case string(MarshallInfoRequest([]byte(challenge))):
+			return [][]byte{[]byte("\xff\xff\xff\xffI\x11Name\x00map\x00tf\x00TF\x00\xb8\x01\x00\x18\x00dl\x00\x01v1\x00")}
+		}
+		return [][]byte{[]byte("\xff\xff\xff\xffA" + challenge)}
+	})
+	c := newTestA2SClient(address)
+
+	players, err := c.Players(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(players) != 1 || players[0].Name != "Player" || players[0].Score != 10 || players[0].Duration != 1 {
+		t.Errorf("Players() = %+v", players)
+	}
+	if got, want := <-requests, "\xff\xff\xff\xffU\xff\xff\xff\xff"; got != want {
+		t.Errorf("first request = %q, want %q", got, want)
+	}
+	if got, want := <-requests, "\xff\xff\xff\xffU"+challenge; got != want {
+		t.Errorf("challenged request = %q, want %q", got, want)
+	}
+
+	// the recent servers also answer A2S_INFO with a challenge, appended to the payload
+	info, err := c.Info(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "Name" || info.AppID != 440 || info.MaxPlayers != 24 {
+		t.Errorf("Info() = %+v", info)
+	}
+	if got, want := <-requests, "\xff\xff\xff\xffTSource Engine Query\x00"; got != want {
+		t.Errorf("first info request = %q, want %q", got, want)
+	}
+	if got, want := <-requests, "\xff\xff\xff\xffTSource Engine Query\x00"+challenge; got != want {
+		t.Errorf("challenged info request = %q, want %q", got, want)
+	}
+}
+
+func TestA2SClientEndlessChallenges(t *testing.T) {
+	var requests int32
+	address := listenTestA2SServer(t, func(request []byte) [][]byte {
+		atomic.AddInt32(&requests, 1)
+		return [][]byte{[]byte("\xff\xff\xff\xffA\x01\x02\x03\x04")}
+	})
+	if _, err := newTestA2SClient(address).Rules(context.Background()); err == nil {
+		t.Fatal("Rules() should fail when the server only sends challenges")
+	}
+	if got := atomic.LoadInt32(&requests); got != maxA2SChallenges+1 {
+		t.Errorf("the client sent %d requests, want %d", got, maxA2SChallenges+1)
+	}
+}
+
+func TestA2SClientUnexpectedHeader(t *testing.T) {
+	address := listenTestA2SServer(t, func(request []byte) [][]byte {
+		return [][]byte{[]byte("\xff\xff\xff\xffE" + testA2SRules)}
+	})
+	if _, err := newTestA2SClient(address).Players(context.Background()); err == nil {
+		t.Error("Players() should fail on a rules reply")
+	}
+}
+
+// splitTestReply splits the reply in parts of the given payload size, with the headers built by header
+func splitTestReply(reply []byte, size int, header func(number int, total int) []byte) [][]byte {
+	total := (len(reply) + size - 1) / size
+	parts := [][]byte{}
+	for number := 0; number < total; number++ {
+		end := (number + 1) * size
+		if end > len(reply) {
+			end = len(reply)
+		}
+		part := append([]byte{}, SplitPacketHeader...)
+		part = append(part, header(number, total)...)
+		parts = append(parts, append(part, reply[number*size:end]...))
+	}
+	return parts
+}
+
+func TestA2SClientSplitReply(t *testing.T) {
+	rules := "\xff\xff\xff\xffE" + testA2SRules
+	want := []Rule{{"mp_timelimit", "30"}, {"sv_gravity", "800"}}
+
+	tests := []struct {
+		name    string
+		dialect Dialect
+		header  func(id uint32, number int, total int) []byte
+	}{
+		{"Source", SourceDialect, func(id uint32, number int, total int) []byte {
+			// ID, total, number and the maximum packet size
+			return []byte{byte(id), byte(id >> 8), byte(id >> 16), byte(id >> 24), byte(total), byte(number), 0xe0, 0x04}
+		}},
+		{"GoldSrc", GoldSrcDialect, func(id uint32, number int, total int) []byte {
+			// ID, then the number in the upper 4 bits and the total in the lower ones
+			return []byte{byte(id), byte(id >> 8), byte(id >> 16), byte(id >> 24), byte(number<<4 | total)}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := listenTestA2SServer(t, func(request []byte) [][]byte {
+				parts := splitTestReply([]byte(rules), 7, func(number int, total int) []byte { return tt.header(0x2a, number, total) })
+				// the parts in the reverse order, with a duplicate and a late part of a previous reply
+				stale := splitTestReply([]byte("\xff\xff\xff\xffEstale"), 7, func(number int, total int) []byte { return tt.header(0x29, number, total+1) })
+				packets := [][]byte{parts[len(parts)-1], stale[0], parts[len(parts)-1]}
+				for i := len(parts) - 2; i >= 0; i-- {
+					packets = append(packets, parts[i])
+				}
+				return packets
+			})
+			c := newTestA2SClient(address)
+			c.Dialect = tt.dialect
+			got, err := c.Rules(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Rules() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseSplitPart(t *testing.T) {
+	source := &A2SClient{Dialect: SourceDialect}
+	goldSrc := &A2SClient{Dialect: GoldSrcDialect}
+	tests := []struct {
+		name   string
+		client *A2SClient
+		packet string
+		want   *splitPart
+	}{
+		{"Source", source, "2a000000" + "03" + "01" + "e004" + "abcd", &splitPart{id: 0x2a, total: 3, number: 1, payload: []byte{0xab, 0xcd}}},
+		{"Source compressed first part", source, "2a000080" + "02" + "00" + "e004" + "10000000" + "78563412" + "abcd",
+			&splitPart{id: 0x8000002a, total: 2, compressed: true, size: 16, checksum: 0x12345678, payload: []byte{0xab, 0xcd}}},
+		{"Source compressed next part", source, "2a000080" + "02" + "01" + "e004" + "abcd", &splitPart{id: 0x8000002a, total: 2, number: 1, compressed: true, payload: []byte{0xab, 0xcd}}},
+		{"GoldSrc", goldSrc, "2a000000" + "12" + "abcd", &splitPart{id: 0x2a, total: 2, number: 1, payload: []byte{0xab, 0xcd}}},
+		{"GoldSrc number out of range", goldSrc, "2a000000" + "22" + "abcd", nil},
+		{"GoldSrc without parts", goldSrc, "2a000000" + "00", nil},
+		{"Source number out of range", source, "2a000000" + "02" + "02" + "e004", nil},
+		{"Source truncated header", source, "2a000000" + "0201", nil},
+		{"Source compressed truncated sizes", source, "2a000080" + "02" + "00" + "e004" + "1000", nil},
+		{"too short", source, "2a0000", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.client.parseSplitPart(mustDecodeHex(t, tt.packet))
+			if tt.want == nil {
+				if err != errA2SSplitPart {
+					t.Errorf("parseSplitPart() = %+v, %v, want %v", got, err, errA2SSplitPart)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseSplitPart() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
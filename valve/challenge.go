@@ -1,6 +1,7 @@
 package valve
 
 import (
+	"bytes"
 	"errors"
 	"reflect"
 	"strconv"
@@ -9,72 +10,208 @@ import (
 
 const challengeTagName string = "challenge"
 
+// Tag options of the heartbeat keys: an optional key may be missing from a heartbeat,
+// its field is left untouched, and an omitempty key isn't written when its field is zero
+const (
+	challengeOptional  string = "optional"
+	challengeOmitEmpty string = "omitempty"
+)
+
+// ChallengeRequest is the body of a heartbeat (0x30), in one of the dialects
 type ChallengeRequest struct {
 	Protocol       int32           `challenge:"protocol"`
 	ChallengeValue int32           `challenge:"challenge"`
 	Players        int32           `challenge:"players"`
 	Max            int32           `challenge:"max"`
-	Bots           bool            `challenge:"bots"`
+	Bots           int32           `challenge:"bots,optional"`
 	GameDir        string          `challenge:"gamedir"`
 	Map            string          `challenge:"map"`
 	Password       bool            `challenge:"password"`
 	OS             OperatingSystem `challenge:"os"`
 	Lan            bool            `challenge:"lan"`
-	Region         Region          `challenge:"region"`
-	Type           string          `challenge:"type"`
+	Region         Region          `challenge:"region,optional"`
+	Type           string          `challenge:"type,optional"`
 	Secure         bool            `challenge:"secure"`
 	Version        string          `challenge:"version"`
-	Product        string          `challenge:"product"`
+	Product        string          `challenge:"product,optional"`
+	// the following keys are only sent by the Source servers
+	GamePort uint16 `challenge:"gameport,optional,omitempty"`
+	SpecPort uint16 `challenge:"specport,optional,omitempty"`
+	AppID    int32  `challenge:"appid,optional,omitempty"`
+	GameType string `challenge:"gametype,optional,omitempty"`
+	// Dialect is detected by UnmarshallHeartbeat
+	Dialect Dialect
+}
+
+// parseChallengeTag returns the key of a tagged field and its options
+func parseChallengeTag(tag string) (key string, optional bool, omitEmpty bool) {
+	options := strings.Split(tag, ",")
+	for _, option := range options[1:] {
+		switch option {
+		case challengeOptional:
+			optional = true
+		case challengeOmitEmpty:
+			omitEmpty = true
+		}
+	}
+	return options[0], optional, omitEmpty
 }
 
+// maxChallengeFields caps the key/value pairs of a heartbeat, the servers send about twenty of them
+const maxChallengeFields = 64
+
+// UnmarshallChallenge parses the body of a heartbeat (0x30), which is a line feed followed by
+// the \key\value pairs and an optional line feed, into the fields tagged with their key.
+// The tagged fields are required unless they are optional, the unknown keys are ignored
+// and a repeated key is an error.
 func UnmarshallChallenge(message []byte, ret interface{}) error {
-	msg := string(message)
-	msg = strings.Trim(msg, "\n")
-	v := reflect.ValueOf(ret).Elem()
+	v := reflect.ValueOf(ret)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return errors.New("The heartbeat can only be parsed into a struct pointer")
+	}
+	pairs, err := parseInfoString(message)
+	if err != nil {
+		return err
+	}
+	return unmarshallPairs(pairs, v.Elem())
+}
+
+// unmarshallPairs sets the tagged fields of the struct value from the heartbeat pairs
+func unmarshallPairs(pairs map[string]string, v reflect.Value) error {
 	t := v.Type()
 	for fi := 0; fi < v.NumField(); fi++ {
 		field := v.Field(fi)
 		tag := t.Field(fi).Tag.Get(challengeTagName)
-		if len(tag) > 0 {
-			tags := strings.Split(tag, ",")
-			fieldName := "\\" + tags[0] + "\\"
-			startField := strings.Index(msg, fieldName)
-			if startField >= 0 {
-				startValue := startField + len(fieldName)
-				endValue := strings.Index(msg[startValue:], "\\") + startValue
-				var valStr string
-				if endValue > startValue {
-					valStr = msg[startValue:endValue]
-				} else {
-					valStr = msg[startValue:]
-				}
-				switch field.Kind() {
-				case reflect.Bool:
-					field.SetBool(valStr == "1")
-				case reflect.Int8:
-				case reflect.Int16:
-				case reflect.Int32:
-					val, err := strconv.Atoi(valStr)
-					if err != nil {
-						return errors.New("The field " + fieldName + " value can't be parsed as an integer")
-					}
-					field.SetInt(int64(val))
-				case reflect.String:
-					field.SetString(valStr)
-				case reflect.Uint8:
-					val, err := strconv.Atoi(valStr)
-					if err != nil {
-						return errors.New("The field " + fieldName + " value can't be parsed as an unsigned integer")
-					}
-					field.SetUint(uint64(val))
-				default:
-					return errors.New("The field " + fieldName + " value has an unsupported type (" + field.Kind().String() + ")")
-				}
-
-			} else {
-				return errors.New("The field " + fieldName + " hasn't been found in the message")
+		if len(tag) == 0 {
+			continue
+		}
+		key, optional, _ := parseChallengeTag(tag)
+		fieldName := "\\" + key + "\\"
+		valStr, found := pairs[key]
+		if !found && optional {
+			continue
+		}
+		if !found {
+			return errors.New("The field " + fieldName + " hasn't been found in the message")
+		}
+		switch field.Kind() {
+		case reflect.Bool:
+			switch valStr {
+			case "0":
+				field.SetBool(false)
+			case "1":
+				field.SetBool(true)
+			default:
+				return errors.New("The field " + fieldName + " value should be 0 or 1")
+			}
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			val, err := strconv.ParseInt(valStr, 10, field.Type().Bits())
+			if err != nil {
+				return errors.New("The field " + fieldName + " value can't be parsed as an integer")
+			}
+			field.SetInt(val)
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			val, err := strconv.ParseUint(valStr, 10, field.Type().Bits())
+			if err != nil {
+				return errors.New("The field " + fieldName + " value can't be parsed as an unsigned integer")
 			}
+			field.SetUint(val)
+		case reflect.String:
+			field.SetString(valStr)
+		default:
+			return errors.New("The field " + fieldName + " value has an unsupported type (" + field.Kind().String() + ")")
 		}
 	}
 	return nil
 }
+
+// MarshallChallenge builds a heartbeat (0x30) from the fields tagged with their key, in the
+// order of the struct fields, so that UnmarshallChallenge parses it back after its header byte.
+// The omitempty fields are omitted when they are zero.
+// A string value can't contain a backslash, a line feed or a null byte.
+func MarshallChallenge(req interface{}) ([]byte, error) {
+	v := reflect.ValueOf(req)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, errors.New("The heartbeat can only be built from a struct")
+	}
+
+	buffer := new(bytes.Buffer)
+	buffer.WriteByte(RequestChallengeHeader)
+	buffer.WriteByte('\n')
+	t := v.Type()
+	for fi := 0; fi < v.NumField(); fi++ {
+		field := v.Field(fi)
+		tag := t.Field(fi).Tag.Get(challengeTagName)
+		if len(tag) == 0 {
+			continue
+		}
+		key, _, omitEmpty := parseChallengeTag(tag)
+		if omitEmpty && field.IsZero() {
+			continue
+		}
+		fieldName := "\\" + key + "\\"
+		var valStr string
+		switch field.Kind() {
+		case reflect.Bool:
+			valStr = "0"
+			if field.Bool() {
+				valStr = "1"
+			}
+		case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			valStr = strconv.FormatInt(field.Int(), 10)
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			valStr = strconv.FormatUint(field.Uint(), 10)
+		case reflect.String:
+			valStr = field.String()
+			if strings.ContainsAny(valStr, "\\\n\x00") {
+				return nil, errors.New("The field " + fieldName + " value can't contain a backslash, a line feed or a null byte")
+			}
+		default:
+			return nil, errors.New("The field " + fieldName + " value has an unsupported type (" + field.Kind().String() + ")")
+		}
+		buffer.WriteString(fieldName)
+		buffer.WriteString(valStr)
+	}
+	buffer.WriteByte('\n')
+	return buffer.Bytes(), nil
+}
+
+// parseInfoString splits the \key\value pairs of a heartbeat body
+func parseInfoString(message []byte) (map[string]string, error) {
+	if len(message) == 0 || message[0] != '\n' {
+		return nil, errors.New("The heartbeat should start with a line feed")
+	}
+	message = message[1:]
+	if len(message) > 0 && message[len(message)-1] == '\n' {
+		message = message[:len(message)-1]
+	}
+	if bytes.IndexByte(message, '\n') >= 0 || bytes.IndexByte(message, 0x00) >= 0 {
+		return nil, errors.New("The heartbeat has an unexpected line feed or null byte")
+	}
+	if len(message) == 0 || message[0] != '\\' {
+		return nil, errors.New("The heartbeat key/value pairs should start with a backslash")
+	}
+
+	tokens := strings.Split(string(message[1:]), "\\")
+	if len(tokens)%2 != 0 {
+		return nil, errors.New("The heartbeat key " + tokens[len(tokens)-1] + " has no value")
+	}
+	if len(tokens)/2 > maxChallengeFields {
+		return nil, errors.New("The heartbeat has too many fields")
+	}
+	pairs := make(map[string]string, len(tokens)/2)
+	for i := 0; i < len(tokens); i += 2 {
+		key := tokens[i]
+		if len(key) == 0 {
+			return nil, errors.New("The heartbeat has an empty key")
+		}
+		if _, found := pairs[key]; found {
+			return nil, errors.New("The heartbeat key " + key + " is repeated")
+		}
+		pairs[key] = tokens[i+1]
+	}
+	return pairs, nil
+}
@@ -0,0 +1,132 @@
+package valve
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var (
+	// ErrTruncated is returned when a packet ends before one of its fields
+	ErrTruncated = errors.New("The packet is truncated")
+	// ErrTrailingData is returned when a packet has bytes left after its last field
+	ErrTrailingData = errors.New("The packet has unexpected trailing data")
+)
+
+// Decoder reads the fields of a packet, checking the remaining length before each read.
+// The first error is kept: the following reads return zero values, so the fields can be
+// read in a row and the error checked once with Err or Finish.
+type Decoder struct {
+	buffer []byte
+	pos    int
+	order  binary.ByteOrder
+	err    error
+}
+
+// NewDecoder creates a decoder reading the integers of the buffer in the given byte order,
+// little-endian for the A2S packets and big-endian for the master server ones
+func NewDecoder(buffer []byte, order binary.ByteOrder) *Decoder {
+	return &Decoder{buffer: buffer, order: order}
+}
+
+// Err returns the first error met by a read
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+// Finish returns the first error met by a read, or ErrTrailingData if bytes are left
+func (d *Decoder) Finish() error {
+	if d.err == nil && d.Remaining() > 0 {
+		d.err = ErrTrailingData
+	}
+	return d.err
+}
+
+// Remaining returns the number of bytes left
+func (d *Decoder) Remaining() int {
+	return len(d.buffer) - d.pos
+}
+
+// Unread returns the bytes left without reading them
+func (d *Decoder) Unread() []byte {
+	return d.buffer[d.pos:]
+}
+
+// Next reads the n next bytes, the returned slice shares the decoder buffer
+func (d *Decoder) Next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || d.Remaining() < n {
+		d.err = ErrTruncated
+		return nil
+	}
+	b := d.buffer[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+// Rest reads all the bytes left
+func (d *Decoder) Rest() []byte {
+	return d.Next(d.Remaining())
+}
+
+// Expect reads the given bytes, the packet is malformed if they differ
+func (d *Decoder) Expect(expected []byte) {
+	b := d.Next(len(expected))
+	if d.err == nil && !bytes.Equal(b, expected) {
+		d.err = errors.New("The packet has unexpected bytes")
+	}
+}
+
+func (d *Decoder) Byte() byte {
+	if b := d.Next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *Decoder) Uint16() uint16 {
+	if b := d.Next(2); b != nil {
+		return d.order.Uint16(b)
+	}
+	return 0
+}
+
+func (d *Decoder) Uint32() uint32 {
+	if b := d.Next(4); b != nil {
+		return d.order.Uint32(b)
+	}
+	return 0
+}
+
+func (d *Decoder) Uint64() uint64 {
+	if b := d.Next(8); b != nil {
+		return d.order.Uint64(b)
+	}
+	return 0
+}
+
+func (d *Decoder) Int32() int32 {
+	return int32(d.Uint32())
+}
+
+func (d *Decoder) Float32() float32 {
+	return math.Float32frombits(d.Uint32())
+}
+
+// String reads a null-terminated string, the packet is truncated if the null byte is missing
+func (d *Decoder) String() string {
+	if d.err != nil {
+		return ""
+	}
+	end := bytes.IndexByte(d.buffer[d.pos:], 0x00)
+	if end < 0 {
+		d.err = ErrTruncated
+		return ""
+	}
+	s := string(d.buffer[d.pos : d.pos+end])
+	d.pos += end + 1
+	return s
+}
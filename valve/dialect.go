@@ -0,0 +1,58 @@
+package valve
+
+import "reflect"
+
+// Dialect is the flavour of the master server protocol spoken by a game server.
+// Both send the same join (q), heartbeat (0\n) and quit (b\n) packets, they differ
+// by the keys of the heartbeats.
+type Dialect string
+
+const (
+	// GoldSrcDialect : Half-Life 1 engine servers, the heartbeats are sent from the game port
+	GoldSrcDialect Dialect = "goldsrc"
+	// SourceDialect : Source engine servers, the heartbeats may be sent from another port
+	// than the game port given with the gameport key, and they carry the app ID and the tags
+	SourceDialect Dialect = "source"
+)
+
+// sourceKeys are the heartbeat keys only sent by the Source servers
+var sourceKeys = []string{"gameport", "specport", "appid", "gametype", "dedicated"}
+
+// detectDialect tells the dialect of a heartbeat from its keys
+func detectDialect(pairs map[string]string) Dialect {
+	for _, key := range sourceKeys {
+		if _, found := pairs[key]; found {
+			return SourceDialect
+		}
+	}
+	return GoldSrcDialect
+}
+
+// UnmarshallHeartbeat parses the body of a heartbeat (0x30) of either dialect, like
+// UnmarshallChallenge, then sets its Dialect and normalizes the values which differ:
+// a missing region is AllRegions, a missing product is the game directory, a missing
+// type comes from the dedicated key of the Source servers, and the 'm' platform of
+// the recent Source servers is OSX.
+func UnmarshallHeartbeat(message []byte, ret *ChallengeRequest) error {
+	pairs, err := parseInfoString(message)
+	if err != nil {
+		return err
+	}
+	*ret = ChallengeRequest{Region: AllRegions}
+	if err = unmarshallPairs(pairs, reflect.ValueOf(ret).Elem()); err != nil {
+		return err
+	}
+
+	ret.Dialect = detectDialect(pairs)
+	if len(ret.Product) == 0 {
+		ret.Product = ret.GameDir
+	}
+	if len(ret.Type) == 0 {
+		ret.Type = Dedicated
+		if dedicated, found := pairs["dedicated"]; found && dedicated != "1" {
+			ret.Type = NonDedicated
+		}
+	}
+	ret.OS = ret.OS.Normalize()
+	return nil
+}
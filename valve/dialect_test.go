@@ -0,0 +1,150 @@
+package valve
+
+import "testing"
+
+// The heartbeats below aren't captures of real servers. They were reconstructed from the documented
+// keys of each dialect, so they can't be tied to an engine build: the versions and values are only
+// plausible ones, and the key order is the one of the documentation.
+const (
+	// a GoldSrc dedicated server of Counter-Strike 1.6 on Linux
+	goldSrcHeartbeat = "0\n\\protocol\\48\\challenge\\1234567\\players\\3\\max\\16\\bots\\0\\gamedir\\cstrike\\map\\de_dust2\\type\\d\\password\\0\\os\\l\\secure\\1\\lan\\0\\version\\1.1.2.7/Stdio\\region\\3\\product\\cstrike\n"
+	// a GoldSrc server sending neither the bots nor the region
+	goldSrcLegacyHeartbeat = "0\n\\protocol\\47\\challenge\\-42\\players\\0\\max\\12\\gamedir\\valve\\map\\crossfire\\type\\l\\password\\1\\os\\w\\secure\\0\\lan\\0\\version\\1.1.0.9\\product\\valve\n"
+	// a Source dedicated server of Team Fortress 2 on macOS, sending its heartbeats from the Steam port
+	sourceHeartbeat = "0\n\\protocol\\7\\challenge\\-1876543210\\players\\5\\max\\24\\bots\\2\\gamedir\\tf\\map\\ctf_2fort\\password\\0\\os\\m\\lan\\0\\region\\255\\gameport\\27016\\specport\\27020\\version\\8622567\\dedicated\\1\\appid\\440\\gametype\\cp,increased_maxplayers\\secure\\1\n"
+	// a Source listen server of Counter-Strike: Source on Windows
+	sourceListenHeartbeat = "0\n\\protocol\\7\\challenge\\99\\players\\1\\max\\10\\bots\\0\\gamedir\\cstrike\\map\\de_nuke\\password\\0\\os\\w\\lan\\1\\region\\0\\gameport\\27015\\specport\\0\\version\\7929486\\dedicated\\0\\appid\\240\\gametype\\\\secure\\0\n"
+)
+
+func TestUnmarshallHeartbeat(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+		want   ChallengeRequest
+	}{
+		{"GoldSrc", goldSrcHeartbeat, ChallengeRequest{
+			Protocol:       48,
+			ChallengeValue: 1234567,
+			Players:        3,
+			Max:            16,
+			GameDir:        "cstrike",
+			Map:            "de_dust2",
+			OS:             OperatingSystem(Linux),
+			Region:         Europe,
+			Type:           Dedicated,
+			Secure:         true,
+			Version:        "1.1.2.7/Stdio",
+			Product:        "cstrike",
+			Dialect:        GoldSrcDialect,
+		}},
+		{"GoldSrc legacy", goldSrcLegacyHeartbeat, ChallengeRequest{
+			Protocol:       47,
+			ChallengeValue: -42,
+			Max:            12,
+			GameDir:        "valve",
+			Map:            "crossfire",
+			Password:       true,
+			OS:             OperatingSystem(Windows),
+			Region:         AllRegions,
+			Type:           NonDedicated,
+			Version:        "1.1.0.9",
+			Product:        "valve",
+			Dialect:        GoldSrcDialect,
+		}},
+		{"Source", sourceHeartbeat, ChallengeRequest{
+			Protocol:       7,
+			ChallengeValue: -1876543210,
+			Players:        5,
+			Max:            24,
+			Bots:           2,
+			GameDir:        "tf",
+			Map:            "ctf_2fort",
+			OS:             OperatingSystem(OSX),
+			Region:         AllRegions,
+			Type:           Dedicated,
+			Secure:         true,
+			Version:        "8622567",
+			Product:        "tf",
+			GamePort:       27016,
+			SpecPort:       27020,
+			AppID:          440,
+			GameType:       "cp,increased_maxplayers",
+			Dialect:        SourceDialect,
+		}},
+		{"Source listen server", sourceListenHeartbeat, ChallengeRequest{
+			Protocol:       7,
+			ChallengeValue: 99,
+			Players:        1,
+			Max:            10,
+			GameDir:        "cstrike",
+			Map:            "de_nuke",
+			OS:             OperatingSystem(Windows),
+			Lan:            true,
+			Region:         USEastCoast,
+			Type:           NonDedicated,
+			Version:        "7929486",
+			Product:        "cstrike",
+			GamePort:       27015,
+			AppID:          240,
+			Dialect:        SourceDialect,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.packet[0] != RequestChallengeHeader {
+				t.Fatalf("The packet header is 0x%02x", tt.packet[0])
+			}
+			var got ChallengeRequest
+			if err := UnmarshallHeartbeat([]byte(tt.packet[1:]), &got); err != nil {
+				t.Fatalf("UnmarshallHeartbeat() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("UnmarshallHeartbeat() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshallHeartbeatErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+	}{
+		{"missing map", "\n\\protocol\\48\\challenge\\1\\players\\0\\max\\8\\gamedir\\cstrike\\password\\0\\os\\l\\secure\\0\\lan\\0\\version\\1.0\n"},
+		{"game port out of range", "\n\\protocol\\7\\challenge\\1\\players\\0\\max\\8\\gamedir\\tf\\map\\x\\password\\0\\os\\l\\secure\\0\\lan\\0\\version\\1.0\\gameport\\65536\n"},
+		{"app ID not a number", "\n\\protocol\\7\\challenge\\1\\players\\0\\max\\8\\gamedir\\tf\\map\\x\\password\\0\\os\\l\\secure\\0\\lan\\0\\version\\1.0\\appid\\tf2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got ChallengeRequest
+			if err := UnmarshallHeartbeat([]byte(tt.packet), &got); err == nil {
+				t.Errorf("UnmarshallHeartbeat() = %+v, want an error", got)
+			}
+		})
+	}
+}
+
+func TestMarshallHeartbeatRoundTrip(t *testing.T) {
+	for _, packet := range []string{goldSrcHeartbeat, goldSrcLegacyHeartbeat, sourceHeartbeat, sourceListenHeartbeat} {
+		var req ChallengeRequest
+		if err := UnmarshallHeartbeat([]byte(packet[1:]), &req); err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := MarshallChallenge(&req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var again ChallengeRequest
+		if err := UnmarshallHeartbeat(encoded[1:], &again); err != nil {
+			t.Fatal(err)
+		}
+		// the keys only sent by the Source servers are omitted when they are zero
+		if req.GamePort != 0 && again.Dialect != req.Dialect {
+			t.Errorf("The dialect of %q is %s once encoded again, want %s", packet, again.Dialect, req.Dialect)
+		}
+		again.Dialect = req.Dialect
+		if again != req {
+			t.Errorf("The heartbeat %q is decoded as\n%+v\nonce encoded again, want\n%+v", packet, again, req)
+		}
+	}
+}
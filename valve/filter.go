@@ -0,0 +1,232 @@
+package valve
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// FilterKey is a key of the Master Server Query Protocol filter language
+type FilterKey string
+
+const (
+	// FilterNand : matches when not all of the following N conditions match
+	FilterNand FilterKey = "nand"
+	// FilterNor : matches when none of the following N conditions match
+	FilterNor              FilterKey = "nor"
+	FilterDedicated        FilterKey = "dedicated"
+	FilterSecure           FilterKey = "secure"
+	FilterGameDir          FilterKey = "gamedir"
+	FilterMap              FilterKey = "map"
+	FilterLinux            FilterKey = "linux"
+	FilterPassword         FilterKey = "password"
+	FilterEmpty            FilterKey = "empty"
+	FilterFull             FilterKey = "full"
+	FilterProxy            FilterKey = "proxy"
+	FilterAppID            FilterKey = "appid"
+	FilterNotAppID         FilterKey = "napp"
+	FilterNoPlayers        FilterKey = "noplayers"
+	FilterWhite            FilterKey = "white"
+	FilterGameType         FilterKey = "gametype"
+	FilterGameData         FilterKey = "gamedata"
+	FilterGameDataOr       FilterKey = "gamedataor"
+	FilterNameMatch        FilterKey = "name_match"
+	FilterVersionMatch     FilterKey = "version_match"
+	FilterCollapseAddrHash FilterKey = "collapse_addr_hash"
+	FilterGameAddr         FilterKey = "gameaddr"
+	FilterIPv6             FilterKey = "ipv6"
+)
+
+type filterValueKind int
+
+const (
+	filterValueString filterValueKind = iota
+	filterValueBool
+	filterValueInt
+	filterValueList
+	filterValueAddr
+	filterValueGroup
+)
+
+var filterKeyKinds = map[FilterKey]filterValueKind{
+	FilterNand:             filterValueGroup,
+	FilterNor:              filterValueGroup,
+	FilterDedicated:        filterValueBool,
+	FilterSecure:           filterValueBool,
+	FilterGameDir:          filterValueString,
+	FilterMap:              filterValueString,
+	FilterLinux:            filterValueBool,
+	FilterPassword:         filterValueBool,
+	FilterEmpty:            filterValueBool,
+	FilterFull:             filterValueBool,
+	FilterProxy:            filterValueBool,
+	FilterAppID:            filterValueInt,
+	FilterNotAppID:         filterValueInt,
+	FilterNoPlayers:        filterValueBool,
+	FilterWhite:            filterValueBool,
+	FilterGameType:         filterValueList,
+	FilterGameData:         filterValueList,
+	FilterGameDataOr:       filterValueList,
+	FilterNameMatch:        filterValueString,
+	FilterVersionMatch:     filterValueString,
+	FilterCollapseAddrHash: filterValueBool,
+	FilterGameAddr:         filterValueAddr,
+	FilterIPv6:             filterValueBool,
+}
+
+// FilterCondition is a single key/value pair of a filter string.
+// The operands of the nand and nor operators are stored in Conditions.
+type FilterCondition struct {
+	Key        FilterKey
+	Value      string
+	Conditions []FilterCondition
+}
+
+// Bool returns the value of a boolean condition
+func (c FilterCondition) Bool() bool {
+	return c.Value == "1"
+}
+
+// Int returns the value of an integer condition, or 0 if it isn't one
+func (c FilterCondition) Int() int {
+	val, _ := strconv.Atoi(c.Value)
+	return val
+}
+
+// Tags returns the comma separated values of a list condition
+func (c FilterCondition) Tags() []string {
+	if len(c.Value) == 0 {
+		return nil
+	}
+	return strings.Split(c.Value, ",")
+}
+
+// Addr returns the IP address and the optional port of a gameaddr condition
+func (c FilterCondition) Addr() (net.IP, uint16) {
+	if ip := net.ParseIP(c.Value); ip != nil {
+		return ip, 0
+	}
+	host, port, err := net.SplitHostPort(c.Value)
+	if err != nil {
+		return nil, 0
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return net.ParseIP(host), uint16(p)
+}
+
+// Filter is a parsed filter string, a server matches it when all its conditions match
+type Filter []FilterCondition
+
+// Lookup returns the first top-level condition with the given key
+func (f Filter) Lookup(key FilterKey) (FilterCondition, bool) {
+	for _, c := range f {
+		if c.Key == key {
+			return c, true
+		}
+	}
+	return FilterCondition{}, false
+}
+
+// String encodes the filter in the filter string format, ParseFilter parses it back
+func (f Filter) String() string {
+	var b strings.Builder
+	writeFilterConditions(&b, f)
+	return b.String()
+}
+
+func writeFilterConditions(b *strings.Builder, conditions []FilterCondition) {
+	for _, c := range conditions {
+		b.WriteString("\\" + string(c.Key) + "\\" + c.Value)
+		writeFilterConditions(b, c.Conditions)
+	}
+}
+
+// ParseFilter parses a filter string like \gamedir\cstrike\nand\2\map\de_dust\empty\1
+func ParseFilter(s string) (Filter, error) {
+	s = strings.TrimRight(s, "\x00")
+	if len(s) == 0 {
+		return Filter{}, nil
+	}
+	if s[0] != '\\' {
+		return nil, errors.New("The filter string should start with a backslash")
+	}
+	tokens := strings.Split(s[1:], "\\")
+	// tolerate a trailing backslash after the last value
+	if len(tokens)%2 == 1 && tokens[len(tokens)-1] == "" {
+		tokens = tokens[:len(tokens)-1]
+	}
+	if len(tokens)%2 == 1 {
+		return nil, errors.New("The filter key " + tokens[len(tokens)-1] + " has no value")
+	}
+	conditions, rest, err := parseFilterConditions(tokens, -1)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("The filter string has trailing tokens")
+	}
+	return Filter(conditions), nil
+}
+
+// parseFilterConditions reads count conditions from tokens (all of them if count is negative)
+// and returns the remaining tokens
+func parseFilterConditions(tokens []string, count int) ([]FilterCondition, []string, error) {
+	conditions := []FilterCondition{}
+	for (count < 0 || len(conditions) < count) && len(tokens) > 0 {
+		key := FilterKey(strings.ToLower(tokens[0]))
+		value := tokens[1]
+		tokens = tokens[2:]
+
+		kind, ok := filterKeyKinds[key]
+		if !ok {
+			return nil, nil, errors.New("The filter key " + string(key) + " is unknown")
+		}
+		if err := validateFilterValue(key, kind, value); err != nil {
+			return nil, nil, err
+		}
+
+		condition := FilterCondition{Key: key, Value: value}
+		if kind == filterValueGroup {
+			n, _ := strconv.Atoi(value)
+			var err error
+			condition.Conditions, tokens, err = parseFilterConditions(tokens, n)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(condition.Conditions) < n {
+				return nil, nil, fmt.Errorf("The filter operator %s expects %d conditions, got %d", key, n, len(condition.Conditions))
+			}
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, tokens, nil
+}
+
+func validateFilterValue(key FilterKey, kind filterValueKind, value string) error {
+	// the value can't end the filter or start another key when it's encoded again
+	if strings.ContainsAny(value, "\\\x00") {
+		return errors.New("The filter key " + string(key) + " value can't contain a backslash or a null byte")
+	}
+	switch kind {
+	case filterValueBool:
+		if value != "0" && value != "1" {
+			return errors.New("The filter key " + string(key) + " expects 0 or 1, got " + value)
+		}
+	case filterValueInt, filterValueGroup:
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return errors.New("The filter key " + string(key) + " expects a positive integer, got " + value)
+		}
+	case filterValueAddr:
+		if ip, _ := (FilterCondition{Value: value}).Addr(); ip == nil {
+			return errors.New("The filter key " + string(key) + " expects an IP address, got " + value)
+		}
+	case filterValueString, filterValueList:
+		if len(value) == 0 {
+			return errors.New("The filter key " + string(key) + " expects a value")
+		}
+	}
+	return nil
+}
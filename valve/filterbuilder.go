@@ -0,0 +1,198 @@
+package valve
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// FilterBuilder builds a Filter condition by condition, like
+//
+//	NewFilterBuilder().GameDir("cstrike").Nand(NewFilterBuilder().Map("de_dust").Empty(true)).Build()
+//
+// The values are validated like ParseFilter does. The filter strings have no escape sequence,
+// so a value containing a backslash or a null byte, or a tag containing a comma, is rejected.
+// The first invalid value is returned by Build.
+type FilterBuilder struct {
+	conditions []FilterCondition
+	err        error
+}
+
+// NewFilterBuilder creates an empty FilterBuilder, which builds a filter matching all the servers
+func NewFilterBuilder() *FilterBuilder {
+	return &FilterBuilder{conditions: []FilterCondition{}}
+}
+
+// Build returns the filter, or the error of the first invalid value
+func (b *FilterBuilder) Build() (Filter, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	return Filter(b.conditions), nil
+}
+
+func (b *FilterBuilder) add(key FilterKey, value string) *FilterBuilder {
+	if b.err != nil {
+		return b
+	}
+	if err := validateFilterValue(key, filterKeyKinds[key], value); err != nil {
+		b.err = err
+		return b
+	}
+	b.conditions = append(b.conditions, FilterCondition{Key: key, Value: value})
+	return b
+}
+
+func (b *FilterBuilder) addBool(key FilterKey, value bool) *FilterBuilder {
+	if value {
+		return b.add(key, "1")
+	}
+	return b.add(key, "0")
+}
+
+func (b *FilterBuilder) addTags(key FilterKey, tags []string) *FilterBuilder {
+	for _, tag := range tags {
+		if len(tag) == 0 || strings.Contains(tag, ",") {
+			if b.err == nil {
+				b.err = errors.New("The filter key " + string(key) + " tags can't be empty or contain a comma")
+			}
+			return b
+		}
+	}
+	return b.add(key, strings.Join(tags, ","))
+}
+
+func (b *FilterBuilder) addGroup(key FilterKey, operands *FilterBuilder) *FilterBuilder {
+	if b.err != nil {
+		return b
+	}
+	if operands.err != nil {
+		b.err = operands.err
+		return b
+	}
+	b.conditions = append(b.conditions, FilterCondition{
+		Key:        key,
+		Value:      strconv.Itoa(len(operands.conditions)),
+		Conditions: operands.conditions,
+	})
+	return b
+}
+
+// Nand matches the servers not matching all the operands conditions
+func (b *FilterBuilder) Nand(operands *FilterBuilder) *FilterBuilder {
+	return b.addGroup(FilterNand, operands)
+}
+
+// Nor matches the servers matching none of the operands conditions
+func (b *FilterBuilder) Nor(operands *FilterBuilder) *FilterBuilder {
+	return b.addGroup(FilterNor, operands)
+}
+
+// Dedicated matches the dedicated servers
+func (b *FilterBuilder) Dedicated(value bool) *FilterBuilder {
+	return b.addBool(FilterDedicated, value)
+}
+
+// Secure matches the servers using anti-cheat technology (VAC, but potentially others as well)
+func (b *FilterBuilder) Secure(value bool) *FilterBuilder {
+	return b.addBool(FilterSecure, value)
+}
+
+// GameDir matches the servers running the mod in the directory, like cstrike
+func (b *FilterBuilder) GameDir(dir string) *FilterBuilder {
+	return b.add(FilterGameDir, dir)
+}
+
+// Map matches the servers running the map
+func (b *FilterBuilder) Map(name string) *FilterBuilder {
+	return b.add(FilterMap, name)
+}
+
+// Linux matches the servers running on a Linux platform
+func (b *FilterBuilder) Linux(value bool) *FilterBuilder {
+	return b.addBool(FilterLinux, value)
+}
+
+// Password matches the servers protected by a password with true, and the other ones with false
+func (b *FilterBuilder) Password(value bool) *FilterBuilder {
+	return b.addBool(FilterPassword, value)
+}
+
+// Empty matches the servers which aren't empty
+func (b *FilterBuilder) Empty(value bool) *FilterBuilder {
+	return b.addBool(FilterEmpty, value)
+}
+
+// Full matches the servers which aren't full
+func (b *FilterBuilder) Full(value bool) *FilterBuilder {
+	return b.addBool(FilterFull, value)
+}
+
+// Proxy matches the spectator proxies
+func (b *FilterBuilder) Proxy(value bool) *FilterBuilder {
+	return b.addBool(FilterProxy, value)
+}
+
+// AppID matches the servers running the app
+func (b *FilterBuilder) AppID(appID int) *FilterBuilder {
+	return b.add(FilterAppID, strconv.Itoa(appID))
+}
+
+// NotAppID matches the servers not running the app
+func (b *FilterBuilder) NotAppID(appID int) *FilterBuilder {
+	return b.add(FilterNotAppID, strconv.Itoa(appID))
+}
+
+// NoPlayers matches the servers which are empty
+func (b *FilterBuilder) NoPlayers(value bool) *FilterBuilder {
+	return b.addBool(FilterNoPlayers, value)
+}
+
+// White matches the whitelisted servers
+func (b *FilterBuilder) White(value bool) *FilterBuilder {
+	return b.addBool(FilterWhite, value)
+}
+
+// GameType matches the servers with all the tags in sv_tags
+func (b *FilterBuilder) GameType(tags ...string) *FilterBuilder {
+	return b.addTags(FilterGameType, tags)
+}
+
+// GameData matches the servers with all the tags in their hidden tags
+func (b *FilterBuilder) GameData(tags ...string) *FilterBuilder {
+	return b.addTags(FilterGameData, tags)
+}
+
+// GameDataOr matches the servers with any of the tags in their hidden tags
+func (b *FilterBuilder) GameDataOr(tags ...string) *FilterBuilder {
+	return b.addTags(FilterGameDataOr, tags)
+}
+
+// NameMatch matches the servers with their hostname matching the pattern, which can use * as a wildcard
+func (b *FilterBuilder) NameMatch(pattern string) *FilterBuilder {
+	return b.add(FilterNameMatch, pattern)
+}
+
+// VersionMatch matches the servers running a version matching the pattern, which can use * as a wildcard
+func (b *FilterBuilder) VersionMatch(pattern string) *FilterBuilder {
+	return b.add(FilterVersionMatch, pattern)
+}
+
+// CollapseAddrHash returns only one server for each unique IP address
+func (b *FilterBuilder) CollapseAddrHash(value bool) *FilterBuilder {
+	return b.addBool(FilterCollapseAddrHash, value)
+}
+
+// GameAddr matches the servers on the IP address, and on the port unless it's 0
+func (b *FilterBuilder) GameAddr(ip net.IP, port uint16) *FilterBuilder {
+	if port == 0 {
+		return b.add(FilterGameAddr, ip.String())
+	}
+	return b.add(FilterGameAddr, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+}
+
+// IPv6 asks for the IPv6 entries in the server list reply, so the IPv6 servers are listed too
+func (b *FilterBuilder) IPv6(value bool) *FilterBuilder {
+	return b.addBool(FilterIPv6, value)
+}
@@ -0,0 +1,40 @@
+package valve
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFilterBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		builder *FilterBuilder
+	}{
+		{"empty string", NewFilterBuilder().GameDir("")},
+		{"backslash", NewFilterBuilder().Map("de\\dust")},
+		{"null byte", NewFilterBuilder().NameMatch("dust\x00")},
+		{"negative app ID", NewFilterBuilder().AppID(-1)},
+		{"empty tag", NewFilterBuilder().GameType("secure", "")},
+		{"tag with a comma", NewFilterBuilder().GameData("a,b")},
+		{"no tag", NewFilterBuilder().GameDataOr()},
+		{"invalid address", NewFilterBuilder().GameAddr(nil, 27015)},
+		{"invalid operand", NewFilterBuilder().Nand(NewFilterBuilder().Map("de\\dust"))},
+		// the following conditions don't hide the first error
+		{"error then valid", NewFilterBuilder().GameDir("").Map("de_dust2").Nor(NewFilterBuilder().Secure(true))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if filter, err := tt.builder.Build(); err == nil {
+				t.Errorf("Build() = %q, want an error", filter)
+			}
+		})
+	}
+
+	filter, err := NewFilterBuilder().GameAddr(net.ParseIP("192.0.2.1"), 27015).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, port := filter[0].Addr(); !ip.Equal(net.ParseIP("192.0.2.1")) || port != 27015 {
+		t.Errorf("Addr() = %v, %d", ip, port)
+	}
+}
@@ -0,0 +1,189 @@
+package valve
+
+import "testing"
+
+// The fuzz targets of the decoders. The seeds are run by go test, and the targets are fuzzed with:
+//
+//	go test -fuzz FuzzHeartbeat ./valve
+//
+// A decoded value is encoded again when the packet has an encoder, and it has to be decoded the same way.
+
+// the heartbeat seeds are written from the documented keys, like the dialect fixtures
+const (
+	goldSrcHeartbeatSeed = "\n\\protocol\\48\\challenge\\1\\players\\1\\max\\8\\bots\\0\\gamedir\\cstrike\\map\\de_dust\\password\\0\\os\\l\\lan\\0\\region\\255\\type\\d\\secure\\1\\version\\1.0\\product\\cstrike\n"
+	sourceHeartbeatSeed  = "\n\\protocol\\7\\challenge\\1\\players\\1\\max\\8\\bots\\0\\gamedir\\tf\\map\\ctf_2fort\\password\\0\\os\\m\\lan\\0\\gameport\\27015\\specport\\0\\dedicated\\0\\appid\\440\\gametype\\a,b\\secure\\1\\version\\1.0\n"
+)
+
+func FuzzServerListRequest(f *testing.F) {
+	f.Add([]byte("\xff0.0.0.0:0\x00\x00"))
+	f.Add([]byte("\x030.0.0.0:0\x00\\gamedir\\cstrike\\nor\\1\\map\\de_dust\x00"))
+	f.Add([]byte("\xff192.0.2.1:27015\x00\\gamedir\\cs\\nor\\1\\map\\x\x00\x01\x02\x03\x04"))
+	f.Add([]byte("\xff0.0.0.0:0\\napp\\500"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var req ServerListRequest
+		if err := UnmarshallServerListRequest(data, &req); err != nil {
+			return
+		}
+		encoded, err := MarshallServerListRequest(&req)
+		if err != nil {
+			t.Fatalf("The decoded server list request can't be encoded: %v", err)
+		}
+		var again ServerListRequest
+		if err := UnmarshallServerListRequest(encoded[1:], &again); err != nil {
+			t.Fatalf("The encoded server list request can't be decoded: %v", err)
+		}
+		// an empty seed is encoded as the null one
+		if len(req.Seed) == 0 {
+			req.Seed = NullSeed
+		}
+		if again.Region != req.Region || again.Seed != req.Seed || again.Filter.String() != req.Filter.String() {
+			t.Fatalf("The encoded server list request is decoded differently: %+v, want %+v", again, req)
+		}
+		if (again.Challenge == nil) != (req.Challenge == nil) || (req.Challenge != nil && *again.Challenge != *req.Challenge) {
+			t.Fatal("The encoded server list request challenge is decoded differently")
+		}
+	})
+}
+
+func FuzzFilter(f *testing.F) {
+	f.Add("")
+	f.Add("\\gamedir\\cstrike\\dedicated\\1")
+	f.Add("\\nand\\2\\map\\a\\gametype\\x,y\\gameaddr\\1.2.3.4:5")
+	f.Add("\\nor\\1\\nand\\1\\napp\\500\\collapse_addr_hash\\1")
+	f.Fuzz(func(t *testing.T, data string) {
+		filter, err := ParseFilter(data)
+		if err != nil {
+			return
+		}
+		again, err := ParseFilter(filter.String())
+		if err != nil {
+			t.Fatalf("The encoded filter can't be parsed: %v", err)
+		}
+		if again.String() != filter.String() {
+			t.Fatalf("The encoded filter is parsed differently: %q, want %q", again.String(), filter.String())
+		}
+	})
+}
+
+func FuzzChallenge(f *testing.F) {
+	f.Add([]byte(goldSrcHeartbeatSeed))
+	f.Add([]byte(sourceHeartbeatSeed))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var req ChallengeRequest
+		if err := UnmarshallChallenge(data, &req); err != nil {
+			return
+		}
+		encoded, err := MarshallChallenge(&req)
+		if err != nil {
+			t.Fatalf("The decoded heartbeat can't be encoded: %v", err)
+		}
+		var again ChallengeRequest
+		if err := UnmarshallChallenge(encoded[1:], &again); err != nil {
+			t.Fatalf("The encoded heartbeat can't be decoded: %v", err)
+		}
+		if again != req {
+			t.Fatalf("The encoded heartbeat is decoded differently: %+v, want %+v", again, req)
+		}
+	})
+}
+
+func FuzzHeartbeat(f *testing.F) {
+	f.Add([]byte(goldSrcHeartbeatSeed))
+	f.Add([]byte(sourceHeartbeatSeed))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var req ChallengeRequest
+		if err := UnmarshallHeartbeat(data, &req); err != nil {
+			return
+		}
+		encoded, err := MarshallChallenge(&req)
+		if err != nil {
+			t.Fatalf("The decoded heartbeat can't be encoded: %v", err)
+		}
+		var again ChallengeRequest
+		if err := UnmarshallHeartbeat(encoded[1:], &again); err != nil {
+			t.Fatalf("The encoded heartbeat can't be decoded: %v", err)
+		}
+		// the dialect is detected from keys which aren't all encoded again
+		again.Dialect = req.Dialect
+		if again != req {
+			t.Fatalf("The encoded heartbeat is decoded differently: %+v, want %+v", again, req)
+		}
+	})
+}
+
+func FuzzServerListReply(f *testing.F) {
+	f.Add([]byte("\x7f\x00\x00\x01\x00\x01\x00\x00\x00\x00\x00\x00"), false)
+	f.Add([]byte("\xc0\x00\x02\x01\x69\x87\xc0\x00\x02\x02\x69\x88"), false)
+	f.Add([]byte("\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x69\x87"), true)
+	f.Fuzz(func(t *testing.T, data []byte, ipv6 bool) {
+		var reply ServerListReply
+		if err := UnmarshallServerListReply(data, ipv6, &reply); err != nil {
+			return
+		}
+		encoded := MarshallServerListReply(&reply)
+		var again ServerListReply
+		if err := UnmarshallServerListReply(encoded[len(ServerListHeader):], reply.IPv6, &again); err != nil {
+			t.Fatalf("The encoded server list reply can't be decoded: %v", err)
+		}
+		if again.Last != reply.Last || len(again.Servers) != len(reply.Servers) {
+			t.Fatal("The encoded server list reply is decoded differently")
+		}
+		for i := range reply.Servers {
+			if !again.Servers[i].IP.Equal(reply.Servers[i].IP) || again.Servers[i].Port != reply.Servers[i].Port {
+				t.Fatalf("The encoded server list entry %d is decoded differently", i)
+			}
+		}
+	})
+}
+
+func FuzzJoinReply(f *testing.F) {
+	f.Add([]byte("\x01\x02\x03\x04"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		challenge, err := UnmarshallJoinReply(data)
+		if err != nil {
+			return
+		}
+		if again, _ := UnmarshallJoinReply(MarshallJoinReply(challenge)[len(ChallengeHeader):]); again != challenge {
+			t.Fatalf("The encoded join reply is decoded differently: %d, want %d", again, challenge)
+		}
+	})
+}
+
+func FuzzJoinRequest(f *testing.F) {
+	f.Add([]byte(""))
+	f.Add([]byte("\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		UnmarshallJoinRequest(data)
+	})
+}
+
+func FuzzQuitRequest(f *testing.F) {
+	f.Add([]byte("\n\x00"))
+	f.Add([]byte("\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		UnmarshallQuitRequest(data)
+	})
+}
+
+func FuzzServerInfo(f *testing.F) {
+	f.Add([]byte("\x11Fake\x00de_dust2\x00cstrike\x00CS\x00\x0a\x00\x03\x10\x00dl\x00\x011.0\x00\xa0\x87\x69tag1,tag2\x00"))
+	f.Add([]byte("\x11Fake\x00de_dust2\x00cstrike\x00CS\x00\x0a\x00\x03\x10\x00dl\x00\x011.0\x00\x01\xf0\x00\x00\x00\x00\x00\x00\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var info ServerInfo
+		UnmarshallServerInfo(data, &info)
+	})
+}
+
+func FuzzPlayers(f *testing.F) {
+	f.Add([]byte("\x02\x00bob\x00\x05\x00\x00\x00\x00\x00\x80\x3f\x01alice\x00\x00\x00\x00\x00\x00\x00\x00\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		UnmarshallPlayers(data)
+	})
+}
+
+func FuzzRules(f *testing.F) {
+	f.Add([]byte("\x02\x00mp_timelimit\x0030\x00sv_gravity\x00800\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		UnmarshallRules(data)
+	})
+}
@@ -0,0 +1,52 @@
+package valve
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// MarshallJoinRequest builds a join request (0x71), which has no body
+func MarshallJoinRequest() []byte {
+	return []byte{RequestJoinHeader}
+}
+
+// UnmarshallJoinRequest checks the body of a join request (0x71), which is empty
+func UnmarshallJoinRequest(message []byte) error {
+	if len(message) > 0 {
+		return ErrTrailingData
+	}
+	return nil
+}
+
+// UnmarshallQuitRequest checks the body of a quit request (0x62), which is a line feed and a null byte
+func UnmarshallQuitRequest(message []byte) error {
+	if !bytes.Equal(message, QuitHeader[1:]) {
+		return errors.New("The quit request body should be a line feed and a null byte")
+	}
+	return nil
+}
+
+// MarshallQuitRequest builds a quit request (0x62)
+func MarshallQuitRequest() []byte {
+	return append([]byte{}, QuitHeader...)
+}
+
+// MarshallJoinReply builds the reply to a join request, which is the challenge
+// to answer in the heartbeat. The list handshakes use the same reply.
+func MarshallJoinReply(challenge int32) []byte {
+	buffer := make([]byte, len(ChallengeHeader)+4)
+	copy(buffer, ChallengeHeader)
+	binary.BigEndian.PutUint32(buffer[len(ChallengeHeader):], uint32(challenge))
+	return buffer
+}
+
+// UnmarshallJoinReply parses the body of a join reply, after its header
+func UnmarshallJoinReply(message []byte) (int32, error) {
+	d := NewDecoder(message, binary.BigEndian)
+	challenge := d.Int32()
+	if err := d.Finish(); err != nil {
+		return 0, err
+	}
+	return challenge, nil
+}
@@ -0,0 +1,206 @@
+package valve
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Sizes of an endpoint in the server list replies, the IPv6 entries are only
+// sent to the clients asking for them with the ipv6 filter key
+const (
+	ServerListIPv4EntrySize = 6
+	ServerListIPv6EntrySize = 18
+)
+
+// NullSeed is the seed of the first server list request
+const NullSeed = "0.0.0.0:0"
+
+// ServerListRequest is the body of a server list query (0x31)
+type ServerListRequest struct {
+	Region Region
+	Seed   string
+	Filter Filter
+	// Challenge answers the handshake challenge of a master server limiting the large replies,
+	// the clients supporting it append the value after the filter. It's nil when absent.
+	Challenge *int32
+}
+
+// MarshallServerListRequest builds a server list query (0x31), an empty seed is the NullSeed
+func MarshallServerListRequest(req *ServerListRequest) ([]byte, error) {
+	seed := req.Seed
+	if len(seed) == 0 {
+		seed = NullSeed
+	}
+	if len(seed) > maxSeedLength || strings.ContainsAny(seed, "\\\x00") {
+		return nil, errors.New("The server list request seed " + seed + " is invalid")
+	}
+	filter := req.Filter.String()
+	if strings.IndexByte(filter, 0x00) >= 0 {
+		return nil, errors.New("The server list request filter can't contain a null byte")
+	}
+	buffer := new(bytes.Buffer)
+	buffer.WriteByte(RequestServerListHeader)
+	buffer.WriteByte(byte(req.Region))
+	buffer.WriteString(seed)
+	buffer.WriteByte(0x00)
+	buffer.WriteString(filter)
+	buffer.WriteByte(0x00)
+	if req.Challenge != nil {
+		binary.Write(buffer, binary.BigEndian, *req.Challenge)
+	}
+	return buffer.Bytes(), nil
+}
+
+// maxSeedLength is the length of the longest seed, an IPv6 endpoint in brackets with its port
+const maxSeedLength = len("[ffff:ffff:ffff:ffff:ffff:ffff:255.255.255.255]:65535")
+
+// UnmarshallServerListRequest parses the body of a server list query,
+// which is the region code followed by the seed IP:port and the filter string,
+// both null-terminated, and optionally by a handshake challenge
+func UnmarshallServerListRequest(message []byte, ret *ServerListRequest) error {
+	d := NewDecoder(message, binary.BigEndian)
+	region := Region(d.Byte())
+	if d.Err() != nil {
+		return errors.New("The server list request has no region code")
+	}
+	if !region.IsValid() {
+		return errors.New("The server list request has an unknown region code (" + strconv.Itoa(int(region)) + ")")
+	}
+
+	// the seed ends at the null byte, or at the filter start for clients omitting it
+	rest := message[1:]
+	seedEnd := bytes.IndexByte(rest, 0x00)
+	if filterStart := bytes.IndexByte(rest, '\\'); seedEnd < 0 || (filterStart >= 0 && filterStart < seedEnd) {
+		seedEnd = filterStart
+	}
+	if seedEnd < 0 {
+		seedEnd = len(rest)
+	}
+	if seedEnd > maxSeedLength {
+		return errors.New("The server list request seed is too long")
+	}
+	seed := string(d.Next(seedEnd))
+	if d.Remaining() > 0 && d.Unread()[0] == 0x00 {
+		d.Byte()
+	}
+
+	// the filter terminator is only missing when the packet ends with the filter
+	var filterString string
+	if bytes.IndexByte(d.Unread(), 0x00) >= 0 {
+		filterString = d.String()
+	} else {
+		filterString = string(d.Rest())
+	}
+	var challenge *int32
+	switch d.Remaining() {
+	case 0:
+	case 4:
+		value := d.Int32()
+		challenge = &value
+	default:
+		return ErrTrailingData
+	}
+	if err := d.Finish(); err != nil {
+		return err
+	}
+
+	filter, err := ParseFilter(filterString)
+	if err != nil {
+		return err
+	}
+	ret.Region = region
+	ret.Seed = seed
+	ret.Filter = filter
+	ret.Challenge = challenge
+	return nil
+}
+
+// ServerAddress is an entry of a server list reply
+type ServerAddress struct {
+	IP   net.IP
+	Port uint16
+}
+
+func (a ServerAddress) String() string {
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(int(a.Port)))
+}
+
+// IsNull checks if the address is the null one terminating the last page of a server list
+func (a ServerAddress) IsNull() bool {
+	return a.Port == 0 && (a.IP == nil || a.IP.IsUnspecified())
+}
+
+// ServerListReply is the body of a server list reply, a page of the servers list
+type ServerListReply struct {
+	Servers []ServerAddress
+	// IPv6 selects the 18 bytes entries, the IPv4 addresses being mapped in IPv6.
+	// An IPv6 address can't be written in the 6 bytes entries, it's written as 0.0.0.0.
+	IPv6 bool
+	// Last is set on the last page, which ends with the null address
+	Last bool
+}
+
+// MarshallServerListReply builds a server list reply
+func MarshallServerListReply(reply *ServerListReply) []byte {
+	entrySize := ServerListIPv4EntrySize
+	if reply.IPv6 {
+		entrySize = ServerListIPv6EntrySize
+	}
+	count := len(reply.Servers)
+	if reply.Last {
+		count++
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, len(ServerListHeader)+count*entrySize))
+	buffer.Write(ServerListHeader)
+	for _, server := range reply.Servers {
+		entry := make([]byte, entrySize)
+		if reply.IPv6 {
+			copy(entry, server.IP.To16())
+		} else if ip4 := server.IP.To4(); ip4 != nil {
+			copy(entry, ip4)
+		} else {
+			copy(entry, net.IPv4zero.To4())
+		}
+		binary.BigEndian.PutUint16(entry[entrySize-2:], server.Port)
+		buffer.Write(entry)
+	}
+	if reply.Last {
+		buffer.Write(make([]byte, entrySize))
+	}
+	return buffer.Bytes()
+}
+
+// UnmarshallServerListReply parses the body of a server list reply, after its header,
+// with the entries size asked in the request. The entries following the null address are ignored.
+func UnmarshallServerListReply(message []byte, ipv6 bool, ret *ServerListReply) error {
+	entrySize := ServerListIPv4EntrySize
+	if ipv6 {
+		entrySize = ServerListIPv6EntrySize
+	}
+	if len(message)%entrySize != 0 {
+		return errors.New("The server list reply size isn't a multiple of the entries size")
+	}
+	ret.IPv6 = ipv6
+	ret.Last = false
+	ret.Servers = make([]ServerAddress, 0, len(message)/entrySize)
+	d := NewDecoder(message, binary.BigEndian)
+	for d.Remaining() > 0 {
+		var server ServerAddress
+		if ipv6 {
+			server.IP = net.IP(append([]byte{}, d.Next(net.IPv6len)...))
+		} else {
+			server.IP = net.IP(append([]byte{}, d.Next(net.IPv4len)...)).To16()
+		}
+		server.Port = d.Uint16()
+		if server.IsNull() {
+			ret.Last = true
+			break
+		}
+		ret.Servers = append(ret.Servers, server)
+	}
+	return d.Err()
+}
@@ -1,21 +1,54 @@
 package valve
 
+import "strconv"
+
 // Region defines a part of the world where servers are located
 type Region uint8
 
 const (
 	// USEastCoast : United States - East Coast
-	USEastCoast  uint8 = 0x00
-	USWestCoast  uint8 = 0x01
-	SouthAmerica uint8 = 0x02
-	Europe       uint8 = 0x03
-	Asia         uint8 = 0x04
-	Australia    uint8 = 0x05
-	MiddleEast   uint8 = 0x06
-	Africa       uint8 = 0x07
-	AllRegions   uint8 = 0xFF
+	USEastCoast  Region = 0x00
+	USWestCoast  Region = 0x01
+	SouthAmerica Region = 0x02
+	Europe       Region = 0x03
+	Asia         Region = 0x04
+	Australia    Region = 0x05
+	MiddleEast   Region = 0x06
+	Africa       Region = 0x07
+	AllRegions   Region = 0xFF
 )
 
+var regionNames = map[Region]string{
+	USEastCoast:  "US East Coast",
+	USWestCoast:  "US West Coast",
+	SouthAmerica: "South America",
+	Europe:       "Europe",
+	Asia:         "Asia",
+	Australia:    "Australia",
+	MiddleEast:   "Middle East",
+	Africa:       "Africa",
+	AllRegions:   "All regions",
+}
+
+// IsValid checks if the region is one of the known region codes
+func (r Region) IsValid() bool {
+	_, ok := regionNames[r]
+	return ok
+}
+
+func (r Region) String() string {
+	if name, ok := regionNames[r]; ok {
+		return name
+	}
+	return "Unknown region (" + strconv.Itoa(int(r)) + ")"
+}
+
+// Includes checks if a server located in the given region should be listed
+// for a query on r. Servers registered for all regions are listed everywhere.
+func (r Region) Includes(server Region) bool {
+	return r == AllRegions || server == AllRegions || r == server
+}
+
 // OperatingSystem defines which platform the server is launched from
 type OperatingSystem string
 
@@ -26,6 +59,25 @@ const (
 	OSX     string = "o"
 )
 
+// Normalize returns the platform in the notation of the heartbeats,
+// the recent servers use 'm' for macOS where the heartbeats use 'o'
+func (o OperatingSystem) Normalize() OperatingSystem {
+	if o == "m" {
+		return OperatingSystem(OSX)
+	}
+	return o
+}
+
+// ServerType defines how the server is hosted
+type ServerType string
+
+const (
+	// Dedicated : dedicated server
+	Dedicated    string = "d"
+	NonDedicated string = "l"
+	Proxy        string = "p"
+)
+
 const (
 	RequestServerListHeader byte = 0x31
 	RequestJoinHeader       byte = 0x71
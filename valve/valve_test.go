@@ -0,0 +1,50 @@
+package valve
+
+import "testing"
+
+var regions = []Region{USEastCoast, USWestCoast, SouthAmerica, Europe, Asia, Australia, MiddleEast, Africa}
+
+func TestRegionIsValid(t *testing.T) {
+	tests := []struct {
+		region Region
+		want   bool
+	}{
+		{USEastCoast, true},
+		{USWestCoast, true},
+		{SouthAmerica, true},
+		{Europe, true},
+		{Asia, true},
+		{Australia, true},
+		{MiddleEast, true},
+		{Africa, true},
+		{AllRegions, true},
+		{0x08, false},
+		{0x7F, false},
+		{0xFE, false},
+	}
+	for _, tt := range tests {
+		if got := tt.region.IsValid(); got != tt.want {
+			t.Errorf("Region(0x%02X).IsValid() = %v, want %v", uint8(tt.region), got, tt.want)
+		}
+	}
+}
+
+func TestRegionIncludes(t *testing.T) {
+	for _, query := range append(regions, AllRegions) {
+		for _, server := range append(regions, AllRegions) {
+			want := query == server || query == AllRegions || server == AllRegions
+			if got := query.Includes(server); got != want {
+				t.Errorf("Region(0x%02X).Includes(0x%02X) = %v, want %v", uint8(query), uint8(server), got, want)
+			}
+		}
+	}
+}
+
+func TestRegionString(t *testing.T) {
+	if got := Europe.String(); got != "Europe" {
+		t.Errorf("Europe.String() = %q", got)
+	}
+	if got := Region(0x42).String(); got != "Unknown region (66)" {
+		t.Errorf("Region(0x42).String() = %q", got)
+	}
+}